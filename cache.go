@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/natrontech/pbs-exporter/collector"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type cacheEntry struct {
+	statusCode int
+	header     http.Header
+	body       []byte
+	tls        *tls.ConnectionState
+	expires    time.Time
+}
+
+// cachingTransport is a http.RoundTripper which caches successful GET responses
+// for the configured ttl, keyed by the request URL and Authorization header.
+// The bodies are held in memory, which includes the complete snapshot lists.
+type cachingTransport struct {
+	next   http.RoundTripper
+	ttl    time.Duration
+	hits   prometheus.Counter
+	misses prometheus.Counter
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+func newCachingTransport(next http.RoundTripper, ttl time.Duration, constLabels prometheus.Labels) *cachingTransport {
+	return &cachingTransport{
+		next: next,
+		ttl:  ttl,
+		hits: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   promNamespace,
+			Subsystem:   "exporter",
+			Name:        "cache_hit_total",
+			Help:        "The number of PBS api responses served from the cache.",
+			ConstLabels: constLabels,
+		}),
+		misses: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   promNamespace,
+			Subsystem:   "exporter",
+			Name:        "cache_miss_total",
+			Help:        "The number of PBS api responses not found in the cache.",
+			ConstLabels: constLabels,
+		}),
+		entries: make(map[string]cacheEntry),
+	}
+}
+
+func (t *cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		return t.next.RoundTrip(req)
+	}
+
+	key := req.Header.Get("Authorization") + " " + req.URL.String()
+	now := time.Now()
+
+	t.mu.Lock()
+	entry, ok := t.entries[key]
+	t.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		t.hits.Inc()
+		header := entry.header.Clone()
+		header.Set(collector.CachedResponseHeader, "hit")
+		return &http.Response{
+			Status:        http.StatusText(entry.statusCode),
+			StatusCode:    entry.statusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        header,
+			Body:          io.NopCloser(bytes.NewReader(entry.body)),
+			ContentLength: int64(len(entry.body)),
+			TLS:           entry.tls,
+			Request:       req,
+		}, nil
+	}
+	t.misses.Inc()
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+
+	// read the body to store it, and hand a copy back to the caller
+	body, err := io.ReadAll(resp.Body)
+	if closeErr := resp.Body.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	t.mu.Lock()
+	// drop expired entries, so responses of targets which are no longer scraped don't pile up
+	for k, e := range t.entries {
+		if now.After(e.expires) {
+			delete(t.entries, k)
+		}
+	}
+	t.entries[key] = cacheEntry{
+		statusCode: resp.StatusCode,
+		header:     resp.Header.Clone(),
+		body:       body,
+		tls:        resp.TLS,
+		expires:    now.Add(t.ttl),
+	}
+	t.mu.Unlock()
+
+	return resp, nil
+}
@@ -0,0 +1,568 @@
+package collector
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultAPIBasePath is the base path of the api of the Proxmox Backup Server
+const DefaultAPIBasePath = "/api2/json"
+
+// CachedResponseHeader marks responses which were served from a cache of the http client instead of PBS.
+// They don't count as requests to the api and don't show that PBS is reachable.
+const CachedResponseHeader = "X-Pbs-Exporter-Cache"
+
+const versionApi = DefaultAPIBasePath + "/version"
+const datastoreUsageApi = DefaultAPIBasePath + "/status/datastore-usage"
+const datastoreApi = DefaultAPIBasePath + "/admin/datastore"
+const datastoreConfigApi = DefaultAPIBasePath + "/config/datastore"
+const configApi = DefaultAPIBasePath + "/config"
+const nodeApi = DefaultAPIBasePath + "/nodes"
+const tapeDriveApi = DefaultAPIBasePath + "/tape/drive"
+const tapeBackupApi = DefaultAPIBasePath + "/tape/backup"
+
+type VersionResponse struct {
+	Data struct {
+		Release string `json:"release"`
+		Repoid  string `json:"repoid"`
+		Version string `json:"version"`
+	} `json:"data"`
+}
+
+type DatastoreResponse struct {
+	Data []Datastore `json:"data"`
+}
+
+// Datastore is an element of the datastore-usage api. The usage is only reported per datastore,
+// namespaces share the chunks of their datastore, so there is no usage per namespace.
+type Datastore struct {
+	Avail       integer `json:"avail"`
+	Store       string  `json:"store"`
+	Total       integer `json:"total"`
+	Used        integer `json:"used"`
+	Error       string  `json:"error"`
+	MountStatus string  `json:"mount-status"`
+
+	// History holds the used fraction of the last month, oldest first, null if there is no data.
+	// It is only reported by the datastore-usage api, like the full date estimated from it.
+	History           []*float64 `json:"history"`
+	EstimatedFullDate *int64     `json:"estimated-full-date"`
+
+	// statusRead is set if the datastore was read from the status api, so it is known to be available.
+	statusRead bool
+}
+
+type DatastoreStatusResponse struct {
+	Data Datastore `json:"data"`
+}
+
+// DatastoreConfigResponse holds the configuration of the datastores, only fields which are safe
+// to expose as labels are decoded.
+type DatastoreConfigResponse struct {
+	Data []DatastoreConfig `json:"data"`
+}
+
+type DatastoreConfig struct {
+	Name          string `json:"name"`
+	Path          string `json:"path"`
+	Comment       string `json:"comment"`
+	BackingDevice string `json:"backing-device"`
+	GCSchedule    string `json:"gc-schedule"`
+
+	// notification settings, the notification mode is only reported by newer PBS versions
+	Notify           string `json:"notify"`
+	NotifyUser       string `json:"notify-user"`
+	NotificationMode string `json:"notification-mode"`
+}
+
+// JobConfigResponse holds the configuration of the verify, prune or sync jobs.
+type JobConfigResponse struct {
+	Data []struct {
+		ID       string `json:"id"`
+		Schedule string `json:"schedule"`
+		Disable  bool   `json:"disable"`
+	} `json:"data"`
+}
+
+// GCResponse is the garbage collection status of a datastore,
+// the job status (last and next run) is only reported by newer PBS versions.
+type GCResponse struct {
+	Data struct {
+		LastRunEnd   *int64 `json:"last-run-endtime"`
+		LastRunState string `json:"last-run-state"`
+		LastRunUPID  string `json:"last-run-upid"`
+		NextRun      *int64 `json:"next-run"`
+
+		// chunk statistics of the last garbage collection
+		DiskChunks     *int64 `json:"disk-chunks"`
+		DiskBytes      *int64 `json:"disk-bytes"`
+		IndexDataBytes *int64 `json:"index-data-bytes"`
+
+		// bad chunks are renamed to .bad by verify jobs, the last garbage collection counts
+		// the ones which are still present (removed if the chunk was uploaded again)
+		StillBad *int64 `json:"still-bad"`
+	} `json:"data"`
+}
+
+type NamespaceResponse struct {
+	Data []struct {
+		Namespace string `json:"ns"`
+	} `json:"data"`
+}
+
+// Snapshot is an element of the data array of the snapshots api. The snapshot list can be huge,
+// so it is decoded one snapshot at a time, see decodeSnapshots.
+type Snapshot struct {
+	BackupType   string `json:"backup-type"`
+	BackupID     string `json:"backup-id"`
+	BackupTime   int64  `json:"backup-time"`
+	Owner        string `json:"owner"`
+	Size         *int64 `json:"size"`
+	VMName       string `json:"comment"`
+	Verification struct {
+		State string `json:"state"`
+	} `json:"verification"`
+}
+
+// backupGroupStats aggregates the snapshots of one backup-id
+type backupGroupStats struct {
+	vmName     string
+	count      int
+	lastTime   int64
+	lastVerify string
+}
+
+type NodesResponse struct {
+	Data []struct {
+		Node string `json:"node"`
+	} `json:"data"`
+}
+
+type TapeDriveResponse struct {
+	Data []struct {
+		Name     string `json:"name"`
+		Activity string `json:"activity"`
+	} `json:"data"`
+}
+
+type TapeBackupJobResponse struct {
+	Data []struct {
+		ID           string `json:"id"`
+		LastRunState string `json:"last-run-state"`
+		LastRunEnd   int64  `json:"last-run-endtime"`
+	} `json:"data"`
+}
+
+type HostResponse struct {
+	Data struct {
+		CPU number `json:"cpu"`
+		Mem struct {
+			Free  integer `json:"free"`
+			Total integer `json:"total"`
+			Used  integer `json:"used"`
+		} `json:"memory"`
+		Swap struct {
+			Free  integer `json:"free"`
+			Total integer `json:"total"`
+			Used  integer `json:"used"`
+		} `json:"swap"`
+		Disk struct {
+			Avail integer `json:"avail"`
+			Total integer `json:"total"`
+			Used  integer `json:"used"`
+		} `json:"root"`
+		Load   []number `json:"loadavg"`
+		Uptime integer  `json:"uptime"`
+		Wait   number   `json:"wait"`
+	} `json:"data"`
+}
+
+type DiskResponse struct {
+	Data []struct {
+		Name    string   `json:"name"`
+		Health  string   `json:"health"`
+		Wearout *float64 `json:"wearout"`
+	} `json:"data"`
+}
+
+// TaskResponse is the response of the tasks api of a node, running tasks have no end time and status.
+type TaskResponse struct {
+	Data []struct {
+		UPID       string `json:"upid"`
+		WorkerType string `json:"worker_type"`
+		WorkerID   string `json:"worker_id"`
+		StartTime  int64  `json:"starttime"`
+		EndTime    *int64 `json:"endtime"`
+		Status     string `json:"status"`
+	} `json:"data"`
+}
+
+// RRDResponse is the response of the rrddata api. Each sample maps the field names
+// (including "time") to their values, which are null if there is no data for that time.
+type RRDResponse struct {
+	Data []map[string]*float64 `json:"data"`
+}
+
+// integer is an int64 which is decoded from a json number or from a string holding a number,
+// as PBS versions differ in the encoding of some numeric fields.
+type integer int64
+
+func (i *integer) UnmarshalJSON(data []byte) error {
+	var value number
+	if err := value.UnmarshalJSON(data); err != nil {
+		return err
+	}
+	*i = integer(value)
+	return nil
+}
+
+// number is a float64 which is decoded from a json number or from a string holding a number,
+// as PBS versions differ in the encoding of some numeric fields.
+type number float64
+
+func (n *number) UnmarshalJSON(data []byte) error {
+	// like for the builtin types, null leaves the value unchanged
+	if string(data) == "null" {
+		return nil
+	}
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		data = []byte(strings.TrimSpace(s))
+	}
+	value, err := strconv.ParseFloat(string(data), 64)
+	if err != nil {
+		return fmt.Errorf("invalid number %s: %w", data, err)
+	}
+	*n = number(value)
+	return nil
+}
+
+// statusError is returned by apiDo if the api does not respond with a 2xx status code.
+type statusError struct {
+	statusCode int
+	endpoint   string
+	path       string
+	body       []byte
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("status code %d returned from endpoint %s for %s", e.statusCode, e.endpoint, e.path)
+}
+
+// errNoData is returned if the data field of a response is missing or null.
+var errNoData = errors.New("response contains no data")
+
+// errNoBody is returned by apiGet for a 2xx response without a body (e.g. 204 No Content),
+// which is only a valid response for lists, see apiGetList.
+var errNoBody = errors.New("response contains no data: empty body")
+
+// apiGet makes a GET request to the given api and decodes the data field of the json response into out,
+// e.g. a pointer to the Data field of one of the response types.
+func (e *Exporter) apiGet(ctx context.Context, api string, params []string, query url.Values, out any) error {
+	return e.apiDo(ctx, api, params, query, func(body io.Reader) error {
+		// debug
+		if e.config.Debug && e.config.LogBodies {
+			var buf bytes.Buffer
+			defer func() {
+				log.Printf("DEBUG: Response body: %s", redactBody(buf.Bytes(), e.config.LogBodiesMaxLength))
+			}()
+			body = io.TeeReader(body, &buf)
+		}
+
+		// parse json in a single pass, PBS might report errors with status code 200
+		envelope := apiResponse{Data: responseData{out: out}}
+		if err := json.NewDecoder(body).Decode(&envelope); err != nil {
+			if errors.Is(err, io.EOF) {
+				return errNoBody
+			}
+			return err
+		}
+		if err := responseErrors(envelope.Errors); err != nil {
+			return err
+		}
+		if !envelope.Data.decoded {
+			return errNoData
+		}
+		return nil
+	})
+}
+
+// apiGetList is apiGet for apis returning a list, a response without a body is an empty list.
+func (e *Exporter) apiGetList(ctx context.Context, api string, params []string, query url.Values, out any) error {
+	err := e.apiGet(ctx, api, params, query, out)
+	if errors.Is(err, errNoBody) {
+		return nil
+	}
+	return err
+}
+
+// secretFieldRegexp matches json string fields which might hold secrets, e.g. "password": "..." or
+// the "ticket" of an authentication
+var secretFieldRegexp = regexp.MustCompile(`(?i)("[^"]*(?:password|secret|token|key|ticket)[^"]*"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+
+// redactBody returns the response body for the debug log with the values of secret fields replaced,
+// truncated to maxLength bytes if maxLength is positive.
+func redactBody(body []byte, maxLength int) string {
+	redacted := secretFieldRegexp.ReplaceAll(body, []byte(`$1"<redacted>"`))
+	if maxLength > 0 && len(redacted) > maxLength {
+		return fmt.Sprintf("%s... (truncated %d bytes)", redacted[:maxLength], len(redacted)-maxLength)
+	}
+	return string(redacted)
+}
+
+// apiResponse is the envelope of all api responses.
+type apiResponse struct {
+	Data   responseData    `json:"data"`
+	Errors json.RawMessage `json:"errors"`
+}
+
+// responseData decodes the data field of a response into out and records whether it was neither missing nor null.
+type responseData struct {
+	out     any
+	decoded bool
+}
+
+func (d *responseData) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	d.decoded = true
+	return json.Unmarshal(data, d.out)
+}
+
+// responseErrors returns an error if the errors field of a response is not empty.
+func responseErrors(raw json.RawMessage) error {
+	switch strings.TrimSpace(string(raw)) {
+	case "", "null", "{}", "[]", `""`:
+		return nil
+	}
+	return fmt.Errorf("response contains errors: %s", raw)
+}
+
+// apiDo makes a GET request to the given api and passes the response body to handle,
+// which allows to process large responses without holding them in memory.
+// The api is a path template like "/api2/json/admin/datastore/{store}/snapshots", its placeholders
+// are replaced by the escaped params in order. The template itself identifies the api in metrics.
+// The response body is always read to EOF and closed, even on errors, so the connection can be reused.
+func (e *Exporter) apiDo(ctx context.Context, api string, params []string, query url.Values, handle func(body io.Reader) error) error {
+	path, err := expandAPIPath(api, params)
+	if err != nil {
+		return err
+	}
+	path = e.config.APIBasePath + strings.TrimPrefix(path, DefaultAPIBasePath)
+
+	u, err := url.Parse(e.config.Endpoint)
+	if err != nil {
+		return err
+	}
+	u = u.JoinPath(path)
+	u.RawQuery = query.Encode()
+
+	// limit the request by the timeout of the api, the deadline of the scrape still applies
+	timeout := e.config.Timeout
+	if api == datastoreApi+"/{store}/snapshots" && e.config.SnapshotTimeout > 0 {
+		timeout = e.config.SnapshotTimeout
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	// add Authorization and User-Agent header, and the basic auth of the endpoint
+	authorization, token := e.authorization()
+	req.Header.Set("Authorization", authorization)
+	req.Header.Set("User-Agent", e.config.UserAgent)
+	if e.proxyAuthorization != "" {
+		req.Header.Set("Proxy-Authorization", e.proxyAuthorization)
+	}
+
+	// debug
+	if e.config.Debug {
+		log.Printf("DEBUG: Request URL: %s", req.URL)
+	}
+
+	// make request and show output
+	resp, err := e.do(req)
+	if err != nil {
+		e.mu.Lock()
+		e.sent = true
+		e.mu.Unlock()
+		return err
+	}
+
+	// retry with the secondary api token if the token in use is rejected, e.g. while it is rotated
+	if resp.StatusCode == http.StatusUnauthorized {
+		if fallback, fallbackToken, ok := e.fallbackAuthorization(token); ok {
+			discardResponse(resp)
+			req.Header.Set("Authorization", fallback)
+			resp, err = e.do(req)
+			if err != nil {
+				e.mu.Lock()
+				e.sent = true
+				e.mu.Unlock()
+				return fmt.Errorf("request with api token %d after api token %d was rejected: %w", fallbackToken, token, err)
+			}
+			if resp.StatusCode != http.StatusUnauthorized {
+				e.setActiveToken(fallbackToken)
+			}
+		}
+	}
+	defer discardResponse(resp)
+
+	// debug
+	if e.config.Debug {
+		log.Printf("DEBUG: Status code %d returned from endpoint: %s (%s)", resp.StatusCode, e.config.Endpoint, resp.Proto)
+	}
+
+	// remember which apis the token is not permitted to read
+	e.recordPermission(api, resp.StatusCode == http.StatusForbidden)
+	cached := resp.Header.Get(CachedResponseHeader) != ""
+	e.mu.Lock()
+	if !cached {
+		e.sent = true
+		e.reachable = true
+	}
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		e.certFingerprint = certFingerprint(resp.TLS.PeerCertificates[0].Raw)
+	}
+	e.mu.Unlock()
+	if !cached {
+		e.config.Stats.apiRequests.WithLabelValues(api, strconv.Itoa(resp.StatusCode)).Inc()
+	}
+
+	// check if status code is 2xx, e.g. a proxy in between might respond with 203
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		return &statusError{statusCode: resp.StatusCode, endpoint: e.config.Endpoint, path: path, body: body}
+	}
+
+	err = handle(resp.Body)
+	if err != nil {
+		return fmt.Errorf("unable to read response of %s: %w", path, err)
+	}
+	return nil
+}
+
+// do sends the request. If the api is rate limited (status code 429), the request is retried once
+// after the delay of the Retry-After header, if the delay ends before the deadline of the scrape.
+func (e *Exporter) do(req *http.Request) (*http.Response, error) {
+	resp, err := e.config.Client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+		return resp, err
+	}
+	e.config.Stats.apiRateLimited.Inc()
+
+	delay, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	if !ok {
+		return resp, nil
+	}
+	if deadline, hasDeadline := req.Context().Deadline(); hasDeadline && time.Now().Add(delay).After(deadline) {
+		return resp, nil
+	}
+	discardResponse(resp)
+
+	log.Printf("WARN: Rate limited by endpoint %s, retrying after %s", e.config.Endpoint, delay)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	case <-timer.C:
+	}
+	return e.config.Client.Do(req)
+}
+
+// certFingerprint returns the sha256 fingerprint of a certificate in the format shown by PBS,
+// lower case hex bytes separated by colons.
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	hexBytes := make([]string, len(sum))
+	for i, b := range sum {
+		hexBytes[i] = hex.EncodeToString([]byte{b})
+	}
+	return strings.Join(hexBytes, ":")
+}
+
+// discardResponse reads the response body to EOF and closes it, so the connection can be reused.
+func discardResponse(resp *http.Response) {
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		log.Printf("Error draining response body: %v", err)
+	}
+	if err := resp.Body.Close(); err != nil {
+		log.Printf("Error closing response body: %v", err)
+	}
+}
+
+// parseRetryAfter returns the delay of a Retry-After header, which is either in seconds or a http date.
+func parseRetryAfter(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return max(date.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// expandAPIPath replaces the placeholders of the api path template with the escaped params.
+func expandAPIPath(api string, params []string) (string, error) {
+	path := api
+	for _, param := range params {
+		start := strings.Index(path, "{")
+		end := strings.Index(path, "}")
+		if start < 0 || end < start {
+			return "", fmt.Errorf("ERROR: Too many parameters for api %s", api)
+		}
+		path = path[:start] + url.PathEscape(param) + path[end+1:]
+	}
+	if strings.Contains(path, "{") {
+		return "", fmt.Errorf("ERROR: Missing parameters for api %s", api)
+	}
+	return path, nil
+}
+
+// recordPermission remembers if a request to api was denied during the current scrape.
+func (e *Exporter) recordPermission(api string, denied bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.permissionDenied[api] = e.permissionDenied[api] || denied
+}
+
+// skipPermissionDenied returns nil if err is caused by missing permissions, so the collection continues
+// with the apis the token is permitted to read. The denied apis are reported by pbs_api_permission_denied.
+func skipPermissionDenied(err error) error {
+	var statusErr *statusError
+	if errors.As(err, &statusErr) && statusErr.statusCode == http.StatusForbidden {
+		log.Printf("WARN: Permission denied, skipping: %s", err)
+		return nil
+	}
+	return err
+}
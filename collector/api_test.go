@@ -0,0 +1,387 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAPIGetErrorsWithStatusOK(t *testing.T) {
+	fixtures := mockFixtures()
+	fixtures[versionApi] = mockResponse{body: `{"data":{"version":"3.2.2"},"errors":{"version":"not allowed"}}`}
+	server := newMockPBS(t, fixtures)
+	exporter := newTestExporter(t, server.URL, nil)
+
+	var response VersionResponse
+	err := exporter.apiGet(context.Background(), versionApi, nil, nil, &response.Data)
+	if err == nil || !strings.Contains(err.Error(), "response contains errors") {
+		t.Errorf("expected an error for the errors of the response, got %v", err)
+	}
+}
+
+func TestAPIGetNoData(t *testing.T) {
+	for name, body := range map[string]string{
+		"null":    `{"data":null}`,
+		"missing": `{"errors":null}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			fixtures := mockFixtures()
+			fixtures[versionApi] = mockResponse{body: body}
+			server := newMockPBS(t, fixtures)
+			exporter := newTestExporter(t, server.URL, nil)
+
+			var response VersionResponse
+			err := exporter.apiGet(context.Background(), versionApi, nil, nil, &response.Data)
+			if err == nil || !strings.HasSuffix(err.Error(), "response contains no data") {
+				t.Errorf("expected an error for the missing data, got %v", err)
+			}
+		})
+	}
+}
+
+func TestAPIGetDecodesData(t *testing.T) {
+	server := newMockPBS(t, mockFixtures())
+	exporter := newTestExporter(t, server.URL, nil)
+
+	var response VersionResponse
+	err := exporter.apiGet(context.Background(), versionApi, nil, nil, &response.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Data.Version != "3.2.2" || response.Data.Release != "3.2" || response.Data.Repoid != "abc123" {
+		t.Errorf("unexpected data %+v", response.Data)
+	}
+}
+
+func TestAPIGetStatusError(t *testing.T) {
+	fixtures := mockFixtures()
+	fixtures[versionApi] = mockResponse{status: http.StatusInternalServerError, body: `{"data":null,"message":"internal error"}`}
+	server := newMockPBS(t, fixtures)
+	exporter := newTestExporter(t, server.URL, nil)
+
+	var response VersionResponse
+	err := exporter.apiGet(context.Background(), versionApi, nil, nil, &response.Data)
+	var statusErr *statusError
+	if !errors.As(err, &statusErr) {
+		t.Fatalf("expected a status error, got %v", err)
+	}
+	if statusErr.statusCode != http.StatusInternalServerError {
+		t.Errorf("expected status code 500, got %d", statusErr.statusCode)
+	}
+	if !strings.Contains(string(statusErr.body), "internal error") {
+		t.Errorf("expected the body in the status error, got %q", statusErr.body)
+	}
+}
+
+func TestAPIDoStatusError(t *testing.T) {
+	fixtures := mockFixtures()
+	fixtures[versionApi] = mockResponse{status: http.StatusServiceUnavailable}
+	server := newMockPBS(t, fixtures)
+	exporter := newTestExporter(t, server.URL, nil)
+
+	handled := false
+	err := exporter.apiDo(context.Background(), versionApi, nil, nil, func(io.Reader) error {
+		handled = true
+		return nil
+	})
+	var statusErr *statusError
+	if !errors.As(err, &statusErr) || statusErr.statusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected a status error with status code 503, got %v", err)
+	}
+	if handled {
+		t.Error("the body of a response with an error status was handled")
+	}
+}
+
+func TestAPIGetInvalidJSON(t *testing.T) {
+	for name, body := range map[string]string{
+		"truncated": `{"data":{"version":"3.2`,
+		"html":      `<html><body>Bad Gateway</body></html>`,
+		"type":      `{"data":{"version":3}}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			fixtures := mockFixtures()
+			fixtures[versionApi] = mockResponse{body: body}
+			server := newMockPBS(t, fixtures)
+			exporter := newTestExporter(t, server.URL, nil)
+
+			var response VersionResponse
+			err := exporter.apiGet(context.Background(), versionApi, nil, nil, &response.Data)
+			if err == nil {
+				t.Error("expected an error for the invalid json")
+			}
+		})
+	}
+}
+
+func TestNumberUnmarshalJSON(t *testing.T) {
+	for _, test := range []struct {
+		json     string
+		expected number
+		valid    bool
+	}{
+		{json: `0.25`, expected: 0.25, valid: true},
+		{json: `"0.25"`, expected: 0.25, valid: true},
+		{json: `" 42 "`, expected: 42, valid: true},
+		{json: `"1e9"`, expected: 1e9, valid: true},
+		{json: `null`, expected: 7, valid: true},
+		{json: `"fast"`},
+		{json: `""`},
+		{json: `true`},
+	} {
+		t.Run(test.json, func(t *testing.T) {
+			value := number(7)
+			err := json.Unmarshal([]byte(test.json), &value)
+			if !test.valid {
+				if err == nil {
+					t.Errorf("expected an error, got %g", value)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value != test.expected {
+				t.Errorf("expected %g, got %g", test.expected, value)
+			}
+		})
+	}
+}
+
+func TestIntegerUnmarshalJSON(t *testing.T) {
+	var response DatastoreResponse
+	err := json.Unmarshal([]byte(`{"data":[{"store":"store1","total":"1000","used":400,"avail":"600"}]}`), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Data) != 1 || response.Data[0].Total != 1000 || response.Data[0].Used != 400 || response.Data[0].Avail != 600 {
+		t.Errorf("unexpected datastores %+v", response.Data)
+	}
+}
+
+func TestAPIGetWithoutBody(t *testing.T) {
+	for _, status := range []int{http.StatusOK, http.StatusNoContent} {
+		t.Run(strconv.Itoa(status), func(t *testing.T) {
+			fixtures := mockFixtures()
+			fixtures[datastoreUsageApi] = mockResponse{status: status}
+			fixtures[versionApi] = mockResponse{status: status}
+			server := newMockPBS(t, fixtures)
+			exporter := newTestExporter(t, server.URL, nil)
+
+			// a list without body is empty
+			var datastores DatastoreResponse
+			err := exporter.apiGetList(context.Background(), datastoreUsageApi, nil, nil, &datastores.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(datastores.Data) != 0 {
+				t.Errorf("expected no datastores, got %d", len(datastores.Data))
+			}
+
+			// an object without body is missing
+			var version VersionResponse
+			err = exporter.apiGet(context.Background(), versionApi, nil, nil, &version.Data)
+			if !errors.Is(err, errNoBody) {
+				t.Errorf("expected an error for the missing data, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCollectListWithoutBody(t *testing.T) {
+	fixtures := mockFixtures()
+	fixtures["/api2/json/admin/datastore/store1/snapshots?ns="] = mockResponse{status: http.StatusNoContent}
+	fixtures["/api2/json/nodes/localhost/disks/list"] = mockResponse{status: http.StatusNoContent}
+	server := newMockPBS(t, fixtures)
+	exporter := newTestExporter(t, server.URL, func(config *Config) {
+		config.CollectDisks = true
+	})
+
+	expected := `
+# HELP pbs_up Was the last query of PBS successful.
+# TYPE pbs_up gauge
+pbs_up 1
+# HELP pbs_snapshot_count The total number of backups.
+# TYPE pbs_snapshot_count gauge
+pbs_snapshot_count{datastore="store1",namespace=""} 0
+pbs_snapshot_count{datastore="store1",namespace="team-a"} 1
+`
+	err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "pbs_up", "pbs_snapshot_count", "pbs_disk_health")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectObjectWithoutBody(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		path    string
+		metrics []string
+	}{
+		{name: "version", path: versionApi, metrics: []string{"pbs_version"}},
+		{name: "node status", path: "/api2/json/nodes/localhost/status", metrics: []string{"pbs_host_memory_total", "pbs_host_uptime", "pbs_host_load1"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fixtures := mockFixtures()
+			fixtures[test.path] = mockResponse{status: http.StatusNoContent}
+			server := newMockPBS(t, fixtures)
+			exporter := newTestExporter(t, server.URL, nil)
+
+			// no metrics with made up values are reported, the collection failed
+			expected := `
+# HELP pbs_up Was the last query of PBS successful.
+# TYPE pbs_up gauge
+pbs_up 0
+`
+			err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), append(test.metrics, "pbs_up")...)
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// snapshotListFixture returns the response of the snapshots api with count snapshots of 100 backup groups.
+func snapshotListFixture(count int) string {
+	var b strings.Builder
+	b.WriteString(`{"data":[`)
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, `{"backup-type":"vm","backup-id":"%d","backup-time":%d,"owner":"root@pam","size":%d,"comment":"vm-%d","verification":{"state":"ok","upid":"UPID:pbs:0000%d:verify"},"files":[{"filename":"index.json.blob","size":512},{"filename":"drive-scsi0.img.fidx","size":%d}]}`,
+			100+i%100, 1700000000+i*3600, 1e9+i, i%100, i, 1e9+i)
+	}
+	b.WriteString(`]}`)
+	return b.String()
+}
+
+// BenchmarkAPIGet decodes a large snapshot list with apiGet.
+func BenchmarkAPIGet(b *testing.B) {
+	fixtures := mockFixtures()
+	fixtures[datastoreApi+"/store1/snapshots"] = mockResponse{body: snapshotListFixture(10000)}
+	server := newMockPBS(b, fixtures)
+	exporter := newTestExporter(b, server.URL, nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var snapshots []Snapshot
+		err := exporter.apiGet(context.Background(), datastoreApi+"/{store}/snapshots", []string{"store1"}, nil, &snapshots)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkAPIGetReadAll decodes the same snapshot list like apiGet did before it decoded the response as a stream:
+// the body is read into memory and unmarshalled, for comparison with BenchmarkAPIGet.
+func BenchmarkAPIGetReadAll(b *testing.B) {
+	fixtures := mockFixtures()
+	fixtures[datastoreApi+"/store1/snapshots"] = mockResponse{body: snapshotListFixture(10000)}
+	server := newMockPBS(b, fixtures)
+	exporter := newTestExporter(b, server.URL, nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var response struct {
+			Data []Snapshot `json:"data"`
+		}
+		err := exporter.apiDo(context.Background(), datastoreApi+"/{store}/snapshots", []string{"store1"}, nil, func(body io.Reader) error {
+			data, err := io.ReadAll(body)
+			if err != nil {
+				return err
+			}
+			return json.Unmarshal(data, &response)
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestRedactBody(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{name: "token", body: `{"token":"s3cr3t"}`, expected: `{"token":"<redacted>"}`},
+		{name: "password", body: `{"password":"s3cr3t"}`, expected: `{"password":"<redacted>"}`},
+		{name: "ticket", body: `{"ticket":"PBS:root@pam:s3cr3t"}`, expected: `{"ticket":"<redacted>"}`},
+		{name: "field name with secret", body: `{"CSRFPreventionToken":"s3cr3t"}`, expected: `{"CSRFPreventionToken":"<redacted>"}`},
+		{name: "case", body: `{"Password":"s3cr3t"}`, expected: `{"Password":"<redacted>"}`},
+		{name: "spacing", body: "{\"token\" :\t \"s3cr3t\"}", expected: "{\"token\" :\t \"<redacted>\"}"},
+		{name: "newline", body: "{\"password\":\n  \"s3cr3t\"}", expected: "{\"password\":\n  \"<redacted>\"}"},
+		{name: "escaped quote", body: `{"password":"s3c\"r3t"}`, expected: `{"password":"<redacted>"}`},
+		{name: "nested", body: `{"data":{"user":{"ticket":"s3cr3t","name":"root@pam"}}}`, expected: `{"data":{"user":{"ticket":"<redacted>","name":"root@pam"}}}`},
+		{name: "list", body: `{"data":[{"token":"s3cr3t"},{"token":"s3cr3t"}]}`, expected: `{"data":[{"token":"<redacted>"},{"token":"<redacted>"}]}`},
+		{name: "other fields", body: `{"store":"s3cr3t"}`, expected: `{"store":"s3cr3t"}`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			redacted := redactBody([]byte(test.body), 0)
+			if redacted != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, redacted)
+			}
+			if test.name != "other fields" && strings.Contains(redacted, "s3cr3t") {
+				t.Errorf("the secret was not redacted: %q", redacted)
+			}
+		})
+	}
+}
+
+func TestRedactBodyTruncated(t *testing.T) {
+	redacted := redactBody([]byte(`{"password":"s3cr3t","store":"store1"}`), 20)
+	if strings.Contains(redacted, "s3") || !strings.Contains(redacted, "(truncated") {
+		t.Errorf("expected the redacted body to be truncated, got %q", redacted)
+	}
+}
+
+func TestStatusErrorWithoutBody(t *testing.T) {
+	fixtures := mockFixtures()
+	fixtures[versionApi] = mockResponse{status: http.StatusInternalServerError, body: `{"data":null,"ticket":"s3cr3t"}`}
+	server := newMockPBS(t, fixtures)
+	exporter := newTestExporter(t, server.URL, nil)
+
+	// the body is only logged redacted, it is not part of the error
+	var response VersionResponse
+	err := exporter.apiGet(context.Background(), versionApi, nil, nil, &response.Data)
+	if err == nil || strings.Contains(err.Error(), "s3cr3t") {
+		t.Errorf("expected an error without the secret, got %v", err)
+	}
+}
+
+func TestAPIDoEncodesNamespace(t *testing.T) {
+	var rawQuery, namespace string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rawQuery = r.URL.RawQuery
+		namespace = r.URL.Query().Get("ns")
+		_, _ = w.Write([]byte(`{"data":[]}`))
+	}))
+	defer server.Close()
+	exporter := newTestExporter(t, server.URL, nil)
+
+	err := exporter.apiDo(context.Background(), datastoreApi+"/{store}/snapshots", []string{"store1"}, url.Values{"ns": {"team-a/prod"}}, func(io.Reader) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rawQuery != "ns=team-a%2Fprod" {
+		t.Errorf("expected the namespace to be encoded in the query, got %q", rawQuery)
+	}
+	if namespace != "team-a/prod" {
+		t.Errorf("expected namespace team-a/prod, got %q", namespace)
+	}
+}
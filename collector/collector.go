@@ -0,0 +1,1048 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func (e *Exporter) collectFromAPI(ctx context.Context, ch chan<- prometheus.Metric) error {
+
+	// get version
+	err := e.getVersion(ctx, ch)
+	if err != nil {
+		return err
+	}
+
+	// get datastore configuration, it is used by the datastore and the job metrics
+	var datastoreConfig *DatastoreConfigResponse
+	if e.config.CollectDatastore {
+		datastoreConfig, err = e.getDatastoreConfig(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	// get datastore metrics, the snapshots of all datastores and namespaces are summed up
+	if e.config.CollectDatastore {
+		snapshotTotal := 0
+		err = skipPermissionDenied(e.getDatastoreMetrics(ctx, ch, datastoreConfig, &snapshotTotal))
+		if err != nil {
+			return err
+		}
+		if e.config.CollectSnapshots {
+			ch <- prometheus.MustNewConstMetric(
+				e.metrics.total_snapshot_count, prometheus.GaugeValue, float64(snapshotTotal),
+			)
+		}
+	}
+
+	// get job metrics
+	if e.config.CollectDatastore {
+		err = e.getJobMetrics(ctx, ch, datastoreConfig)
+		if err != nil {
+			return err
+		}
+	}
+
+	// get node metrics
+	if e.config.CollectNode {
+		err = skipPermissionDenied(e.getNodeMetrics(ctx, ch))
+		if err != nil {
+			return err
+		}
+	}
+
+	// get tape metrics
+	if e.config.CollectTape {
+		err = skipPermissionDenied(e.getTapeMetrics(ctx, ch))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *Exporter) getDatastoreMetrics(ctx context.Context, ch chan<- prometheus.Metric, datastoreConfig *DatastoreConfigResponse, snapshotTotal *int) error {
+	// get datastores, a single configured datastore doesn't require the list
+	var response DatastoreResponse
+	var err error
+	if e.config.Datastore != "" {
+		var datastore Datastore
+		datastore, err = e.getDatastoreStatus(ctx, e.config.Datastore)
+		response.Data = []Datastore{datastore}
+	} else {
+		err = e.apiGetList(ctx, datastoreUsageApi, nil, nil, &response.Data)
+	}
+	if err != nil {
+		return err
+	}
+
+	// set datastore count
+	ch <- prometheus.MustNewConstMetric(
+		e.metrics.datastore_count, prometheus.GaugeValue, float64(len(response.Data)),
+	)
+
+	// the list is filtered by the privileges of the token, so an empty list is most likely a permission problem
+	if len(response.Data) == 0 {
+		log.Printf("WARN: No datastores returned from endpoint %s, check the Datastore.Audit privilege of the token", e.config.Endpoint)
+	}
+
+	// set datastore configuration
+	e.setDatastoreInfo(ch, datastoreConfig)
+
+	// for each datastore collect metrics, a failing datastore doesn't stop the collection of the others
+	var errs []error
+	for _, datastore := range response.Data {
+		err := skipPermissionDenied(e.getDatastoreMetric(ctx, datastore, ch, snapshotTotal))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("datastore %s: %w", datastore.Store, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// getDatastoreStatus returns the usage of a single datastore.
+func (e *Exporter) getDatastoreStatus(ctx context.Context, store string) (Datastore, error) {
+	var response DatastoreStatusResponse
+	err := e.apiGet(ctx, datastoreApi+"/{store}/status", []string{store}, nil, &response.Data)
+	var statusErr *statusError
+	if errors.As(err, &statusErr) && statusErr.statusCode != http.StatusForbidden {
+		return Datastore{}, fmt.Errorf("datastore %s does not exist or is not available: %w", store, err)
+	}
+	if err != nil {
+		return Datastore{}, err
+	}
+
+	datastore := response.Data
+	datastore.Store = store
+	datastore.statusRead = true
+	return datastore, nil
+}
+
+// getDatastoreConfig returns the configuration of all datastores (or only of the configured datastore),
+// nil if the token is not permitted to read it.
+func (e *Exporter) getDatastoreConfig(ctx context.Context) (*DatastoreConfigResponse, error) {
+	var response DatastoreConfigResponse
+	var err error
+	if e.config.Datastore != "" {
+		response.Data = make([]DatastoreConfig, 1)
+		err = e.apiGet(ctx, datastoreConfigApi+"/{store}", []string{e.config.Datastore}, nil, &response.Data[0])
+		response.Data[0].Name = e.config.Datastore
+	} else {
+		err = e.apiGetList(ctx, datastoreConfigApi, nil, nil, &response.Data)
+	}
+	if err != nil {
+		return nil, skipPermissionDenied(err)
+	}
+	return &response, nil
+}
+
+// setDatastoreInfo sets the metrics of the datastore configuration, if it could be read.
+func (e *Exporter) setDatastoreInfo(ch chan<- prometheus.Metric, response *DatastoreConfigResponse) {
+	if response == nil {
+		return
+	}
+
+	for _, datastore := range response.Data {
+		// only the configured datastore is exported, like its other metrics
+		if e.config.Datastore != "" && datastore.Name != e.config.Datastore {
+			continue
+		}
+
+		datastoreType := "local"
+		if datastore.BackingDevice != "" {
+			datastoreType = "removable"
+		}
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.datastore_info, prometheus.GaugeValue, 1, datastore.Name, datastore.Path, datastoreType, sanitizeComment(datastore.Comment),
+		)
+
+		// the notification system sends the job results to the globally configured targets,
+		// the legacy mode only if notify settings or a user are set
+		notifyConfigured := 0
+		if datastore.NotificationMode == "notification-system" || datastore.Notify != "" || datastore.NotifyUser != "" {
+			notifyConfigured = 1
+		}
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.datastore_notify_configured, prometheus.GaugeValue, float64(notifyConfigured), datastore.Name,
+		)
+
+		// a missing schedule is reported as none, so it is visible instead of a missing series
+		schedule := datastore.GCSchedule
+		if schedule == "" {
+			schedule = "none"
+		}
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.gc_schedule_info, prometheus.GaugeValue, 1, datastore.Name, schedule,
+		)
+	}
+}
+
+// maxCommentLength is the maximum number of characters of a comment used as label value
+const maxCommentLength = 256
+
+// sanitizeComment converts a comment of the PBS config into a single line label value of limited length,
+// e.g. so tags in the comment of a datastore can be matched with a regular expression in dashboards.
+func sanitizeComment(comment string) string {
+	comment = strings.Join(strings.Fields(strings.ToValidUTF8(comment, "\uFFFD")), " ")
+	if runes := []rune(comment); len(runes) > maxCommentLength {
+		comment = string(runes[:maxCommentLength])
+	}
+	return comment
+}
+
+func (e *Exporter) getJobMetrics(ctx context.Context, ch chan<- prometheus.Metric, datastoreConfig *DatastoreConfigResponse) error {
+	// garbage collection is configured per datastore, it is enabled by a schedule
+	if datastoreConfig != nil {
+		enabled := 0
+		for _, datastore := range datastoreConfig.Data {
+			if datastore.GCSchedule != "" {
+				enabled++
+			}
+		}
+		e.setJobMetrics(ch, "gc", len(datastoreConfig.Data), enabled)
+	}
+
+	// the other jobs run on their schedule unless they are disabled
+	for _, jobType := range []string{"verify", "prune", "sync"} {
+		var jobs JobConfigResponse
+		err := e.apiGetList(ctx, configApi+"/"+jobType, nil, nil, &jobs.Data)
+		if err == nil {
+			enabled := 0
+			for _, job := range jobs.Data {
+				if job.Schedule != "" && !job.Disable {
+					enabled++
+				}
+			}
+			e.setJobMetrics(ch, jobType, len(jobs.Data), enabled)
+		}
+		err = skipPermissionDenied(err)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *Exporter) setJobMetrics(ch chan<- prometheus.Metric, jobType string, configured int, enabled int) {
+	ch <- prometheus.MustNewConstMetric(
+		e.metrics.configured_jobs, prometheus.GaugeValue, float64(configured), jobType,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		e.metrics.enabled_jobs, prometheus.GaugeValue, float64(enabled), jobType,
+	)
+}
+
+func (e *Exporter) getVersion(ctx context.Context, ch chan<- prometheus.Metric) error {
+	// get version
+	var response VersionResponse
+	err := e.apiGet(ctx, versionApi, nil, nil, &response.Data)
+	if err != nil {
+		return err
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		e.metrics.version, prometheus.GaugeValue, 1, response.Data.Version, response.Data.Repoid, response.Data.Release,
+	)
+
+	return nil
+}
+
+func (e *Exporter) getNodeMetrics(ctx context.Context, ch chan<- prometheus.Metric) error {
+	// get nodes, the node name is required by the node apis (won't work with the node ip)
+	// see: https://pbs.proxmox.com/docs/api-viewer/index.html#/nodes
+	var response NodesResponse
+	err := e.apiGetList(ctx, nodeApi, nil, nil, &response.Data)
+	if err != nil {
+		return err
+	}
+
+	// collect all nodes, even if one of them fails, e.g. because it is offline
+	var errs []error
+	for _, node := range response.Data {
+		err = skipPermissionDenied(e.getNodeMetric(ctx, node.Node, ch))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("node %s: %w", node.Node, err))
+			continue
+		}
+
+		// get disk metrics, they are optional so a failure doesn't fail the collection
+		if e.config.CollectDisks {
+			err = skipPermissionDenied(e.getDiskMetrics(ctx, node.Node, ch))
+			if err != nil {
+				log.Printf("WARN: Unable to collect the disks of node %s from endpoint %s: %s", node.Node, e.config.Endpoint, err)
+			}
+		}
+
+		// get task metrics
+		err = skipPermissionDenied(e.getTaskMetrics(ctx, node.Node, ch))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("node %s: %w", node.Node, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (e *Exporter) getNodeMetric(ctx context.Context, node string, ch chan<- prometheus.Metric) error {
+	var response HostResponse
+	err := e.apiGet(ctx, nodeApi+"/{node}/status", []string{node}, nil, &response.Data)
+	if err != nil {
+		return err
+	}
+
+	// set host metrics
+	ch <- prometheus.MustNewConstMetric(
+		e.metrics.host_cpu_usage, prometheus.GaugeValue, float64(response.Data.CPU), node,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		e.metrics.host_memory_free, prometheus.GaugeValue, float64(response.Data.Mem.Free), node,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		e.metrics.host_memory_total, prometheus.GaugeValue, float64(response.Data.Mem.Total), node,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		e.metrics.host_memory_used, prometheus.GaugeValue, float64(response.Data.Mem.Used), node,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		e.metrics.host_swap_free, prometheus.GaugeValue, float64(response.Data.Swap.Free), node,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		e.metrics.host_swap_total, prometheus.GaugeValue, float64(response.Data.Swap.Total), node,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		e.metrics.host_swap_used, prometheus.GaugeValue, float64(response.Data.Swap.Used), node,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		e.metrics.host_disk_available, prometheus.GaugeValue, float64(response.Data.Disk.Avail), node,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		e.metrics.host_disk_total, prometheus.GaugeValue, float64(response.Data.Disk.Total), node,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		e.metrics.host_disk_used, prometheus.GaugeValue, float64(response.Data.Disk.Used), node,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		e.metrics.host_uptime, prometheus.GaugeValue, float64(response.Data.Uptime), node,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		e.metrics.host_io_wait, prometheus.GaugeValue, float64(response.Data.Wait), node,
+	)
+
+	// the load is not reported by all PBS versions
+	if len(response.Data.Load) >= 3 {
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.host_load1, prometheus.GaugeValue, float64(response.Data.Load[0]), node,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.host_load5, prometheus.GaugeValue, float64(response.Data.Load[1]), node,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.host_load15, prometheus.GaugeValue, float64(response.Data.Load[2]), node,
+		)
+	}
+
+	// get network statistics of node
+	var rrd RRDResponse
+	err = e.apiGetList(ctx, nodeApi+"/{node}/rrd", []string{node}, url.Values{"timeframe": {"hour"}, "cf": {"AVERAGE"}}, &rrd.Data)
+	if err != nil {
+		return err
+	}
+	if value, ok := latestRRDValue(rrd, "netin"); ok {
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.host_net_in_bytes, prometheus.GaugeValue, value, node,
+		)
+	}
+	if value, ok := latestRRDValue(rrd, "netout"); ok {
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.host_net_out_bytes, prometheus.GaugeValue, value, node,
+		)
+	}
+
+	return nil
+}
+
+func (e *Exporter) getDiskMetrics(ctx context.Context, node string, ch chan<- prometheus.Metric) error {
+	// NOTE: the disk list also reads the SMART health of each disk, which can take a while on hosts
+	// with many disks. Partitions are excluded (default of the api) to keep the response small.
+	var response DiskResponse
+	err := e.apiGetList(ctx, nodeApi+"/{node}/disks/list", []string{node}, nil, &response.Data)
+	if err != nil {
+		return err
+	}
+
+	// set disk metrics
+	for _, disk := range response.Data {
+		health := -1
+		switch strings.ToUpper(disk.Health) {
+		case "PASSED", "OK":
+			health = 1
+		case "FAILED":
+			health = 0
+		}
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.disk_health, prometheus.GaugeValue, float64(health), node, disk.Name,
+		)
+
+		// wearout is only reported for SSDs
+		if disk.Wearout != nil {
+			ch <- prometheus.MustNewConstMetric(
+				e.metrics.disk_wearout, prometheus.GaugeValue, *disk.Wearout, node, disk.Name,
+			)
+		}
+	}
+
+	return nil
+}
+
+// taskLimit is the number of most recent failed or running tasks requested from the tasks api
+const taskLimit = 500
+
+func (e *Exporter) getTaskMetrics(ctx context.Context, node string, ch chan<- prometheus.Metric) error {
+	// only request failed tasks, warnings are failures as well
+	var response TaskResponse
+	query := url.Values{"errors": {"1"}, "limit": {strconv.Itoa(taskLimit)}}
+	err := e.apiGetList(ctx, nodeApi+"/{node}/tasks", []string{node}, query, &response.Data)
+	if err != nil {
+		return err
+	}
+
+	// keep the most recent failure of each type only, to bound the number of series
+	type failedTask struct {
+		upid     string
+		workerID string
+		endTime  int64
+	}
+	lastFailed := make(map[string]failedTask)
+	for _, task := range response.Data {
+		if task.EndTime == nil || task.Status == "" || task.Status == "OK" {
+			continue
+		}
+		if last, ok := lastFailed[task.WorkerType]; ok && last.endTime >= *task.EndTime {
+			continue
+		}
+		lastFailed[task.WorkerType] = failedTask{upid: task.UPID, workerID: task.WorkerID, endTime: *task.EndTime}
+	}
+
+	for workerType, task := range lastFailed {
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.last_failed_task, prometheus.GaugeValue, float64(task.endTime), node, workerType, task.upid, task.workerID,
+		)
+	}
+
+	// get running tasks and keep the oldest start time of each type, e.g. to find a stuck verify
+	var running TaskResponse
+	query = url.Values{"running": {"1"}, "limit": {strconv.Itoa(taskLimit)}}
+	err = e.apiGetList(ctx, nodeApi+"/{node}/tasks", []string{node}, query, &running.Data)
+	if err != nil {
+		return err
+	}
+	oldestStart := make(map[string]int64)
+	for _, task := range running.Data {
+		if start, ok := oldestStart[task.WorkerType]; !ok || task.StartTime < start {
+			oldestStart[task.WorkerType] = task.StartTime
+		}
+	}
+	for workerType, start := range oldestStart {
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.oldest_running_task_age_seconds, prometheus.GaugeValue,
+			max(time.Since(time.Unix(start, 0)).Seconds(), 0), node, workerType,
+		)
+	}
+
+	return nil
+}
+
+func (e *Exporter) getTapeMetrics(ctx context.Context, ch chan<- prometheus.Metric) error {
+	// get tape drives, the activity is only reported if queried
+	var drives TapeDriveResponse
+	err := e.apiGetList(ctx, tapeDriveApi, nil, url.Values{"query-activity": {"true"}}, &drives.Data)
+	if err != nil {
+		return err
+	}
+	for _, drive := range drives.Data {
+		activity := drive.Activity
+		if activity == "" {
+			activity = "unknown"
+		}
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.tape_drive_status, prometheus.GaugeValue, 1, drive.Name, activity,
+		)
+	}
+
+	// get tape backup jobs
+	var jobs TapeBackupJobResponse
+	err = skipPermissionDenied(e.apiGetList(ctx, tapeBackupApi, nil, nil, &jobs.Data))
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs.Data {
+		// jobs which never ran have no last run
+		if job.LastRunState == "" {
+			continue
+		}
+		status := 0
+		if job.LastRunState == "OK" {
+			status = 1
+		}
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.tape_backup_job_status, prometheus.GaugeValue, float64(status), job.ID,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.tape_backup_last_run_timestamp, prometheus.GaugeValue, float64(job.LastRunEnd), job.ID,
+		)
+	}
+
+	return nil
+}
+
+func (e *Exporter) getDatastoreMetric(ctx context.Context, datastore Datastore, ch chan<- prometheus.Metric, snapshotTotal *int) error {
+	// debug
+	if e.config.Debug {
+		log.Printf("DEBUG: --Store %s", datastore.Store)
+		log.Printf("DEBUG: --Avail %d", datastore.Avail)
+		log.Printf("DEBUG: --Total %d", datastore.Total)
+		log.Printf("DEBUG: --Used %d", datastore.Used)
+	}
+
+	// the mount status is only reported for removable datastores by newer PBS versions
+	if datastore.MountStatus == "mounted" || datastore.MountStatus == "notmounted" {
+		mounted := 0
+		if datastore.MountStatus == "mounted" {
+			mounted = 1
+		}
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.removable_datastore_mounted, prometheus.GaugeValue, float64(mounted), datastore.Store,
+		)
+	}
+
+	// check if the datastore is available, e.g. a removable or network datastore might not be mounted
+	available, err := e.datastoreAvailable(ctx, datastore)
+	if err != nil {
+		return err
+	}
+	availableValue := 0
+	if available {
+		availableValue = 1
+	}
+	ch <- prometheus.MustNewConstMetric(
+		e.metrics.datastore_available, prometheus.GaugeValue, float64(availableValue), datastore.Store,
+	)
+	if !available {
+		log.Printf("WARN: Datastore: %s is not available, Skip scrape datastore metric", datastore.Store)
+
+		// the usage history still holds the last known used fraction
+		if value, ok := latestHistoryValue(datastore.History); ok && e.config.UsageHistory {
+			ch <- prometheus.MustNewConstMetric(
+				e.metrics.datastore_used_fraction, prometheus.GaugeValue, value, datastore.Store,
+			)
+		}
+		return nil
+	}
+
+	// set datastore metrics
+	ch <- prometheus.MustNewConstMetric(
+		e.metrics.available, prometheus.GaugeValue, float64(datastore.Avail), datastore.Store,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		e.metrics.size, prometheus.GaugeValue, float64(datastore.Total), datastore.Store,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		e.metrics.used, prometheus.GaugeValue, float64(datastore.Used), datastore.Store,
+	)
+
+	// the total is 0 if the datastore is not available
+	if datastore.Total > 0 {
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.datastore_used_fraction, prometheus.GaugeValue, float64(datastore.Used)/float64(datastore.Total), datastore.Store,
+		)
+	}
+
+	// the estimated full date is 0 or negative if the usage does not grow
+	if e.config.UsageHistory && datastore.EstimatedFullDate != nil && *datastore.EstimatedFullDate > 0 {
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.datastore_estimated_full_timestamp, prometheus.GaugeValue, float64(*datastore.EstimatedFullDate), datastore.Store,
+		)
+	}
+
+	// get io statistics of datastore
+	var rrd RRDResponse
+	err = e.apiGetList(ctx, datastoreApi+"/{store}/rrddata", []string{datastore.Store}, url.Values{"timeframe": {"hour"}, "cf": {"AVERAGE"}}, &rrd.Data)
+	if err != nil {
+		return err
+	}
+	if value, ok := latestRRDValue(rrd, "read_bytes"); ok {
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.datastore_read_bytes, prometheus.GaugeValue, value, datastore.Store,
+		)
+	}
+	if value, ok := latestRRDValue(rrd, "write_bytes"); ok {
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.datastore_write_bytes, prometheus.GaugeValue, value, datastore.Store,
+		)
+	}
+
+	// get garbage collection status of datastore
+	var gc GCResponse
+	err = e.apiGet(ctx, datastoreApi+"/{store}/gc", []string{datastore.Store}, nil, &gc.Data)
+	if err != nil {
+		return err
+	}
+	if gc.Data.LastRunEnd != nil {
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.gc_last_run_timestamp, prometheus.GaugeValue, float64(*gc.Data.LastRunEnd), datastore.Store,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.gc_seconds_since_last_run, prometheus.GaugeValue, float64(time.Now().Unix()-*gc.Data.LastRunEnd), datastore.Store,
+		)
+	}
+
+	// set chunk statistics, they are counted by the garbage collection
+	if gc.Data.DiskChunks != nil {
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.datastore_chunk_count, prometheus.GaugeValue, float64(*gc.Data.DiskChunks), datastore.Store,
+		)
+	}
+	if gc.Data.DiskBytes != nil {
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.datastore_chunk_bytes, prometheus.GaugeValue, float64(*gc.Data.DiskBytes), datastore.Store,
+		)
+	}
+	if gc.Data.IndexDataBytes != nil {
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.datastore_index_data_bytes, prometheus.GaugeValue, float64(*gc.Data.IndexDataBytes), datastore.Store,
+		)
+	}
+	if gc.Data.StillBad != nil {
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.gc_bad_chunks, prometheus.GaugeValue, float64(*gc.Data.StillBad), datastore.Store,
+		)
+	}
+
+	// a started job has an upid, but no state until it is finished
+	running := gc.Data.LastRunUPID != "" && gc.Data.LastRunState == ""
+	if gc.Data.LastRunUPID != "" {
+		runningValue := 0
+		if running {
+			runningValue = 1
+		}
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.gc_running, prometheus.GaugeValue, float64(runningValue), datastore.Store,
+		)
+	}
+
+	// the next run is only set if there is a schedule, it is in the past if the scheduled run is missing
+	if gc.Data.NextRun != nil {
+		overdue := 0
+		if !running && *gc.Data.NextRun < time.Now().Unix() {
+			overdue = 1
+		}
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.gc_overdue, prometheus.GaugeValue, float64(overdue), datastore.Store,
+		)
+	}
+
+	// snapshot enumeration is the most expensive part of a scrape, skip it if disabled
+	if !e.config.CollectSnapshots {
+		return nil
+	}
+
+	// get namespaces of datastore, a single configured namespace doesn't require the list
+	namespaces := []string{e.config.DatastoreNamespace}
+	if e.config.DatastoreNamespace == "" {
+		var response NamespaceResponse
+		err = e.apiGetList(ctx, datastoreApi+"/{store}/namespace", []string{datastore.Store}, nil, &response.Data)
+		if err != nil {
+			var statusErr *statusError
+			if errors.As(err, &statusErr) && statusErr.statusCode == 400 {
+				// check if datastore is being deleted
+				isBeingDeleted, err := regexp.MatchString("(?i)datastore is being deleted", string(statusErr.body))
+				if err != nil {
+					return err
+				}
+				if isBeingDeleted {
+					log.Printf("INFO: Datastore: %s is being deleted, Skip scrape datastore metric", datastore.Store)
+					return nil
+				}
+			}
+			return err
+		}
+
+		// set namespace count, the list includes the root namespace
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.namespace_count, prometheus.GaugeValue, float64(len(response.Data)), datastore.Store,
+		)
+
+		namespaces = namespaces[:0]
+		for _, namespace := range response.Data {
+			namespaces = append(namespaces, namespace.Namespace)
+		}
+	}
+
+	// for each namespace collect metrics, failed namespaces are skipped and counted
+	var newestSnapshot int64
+	sizes := newSizeHistogram(e.config.SnapshotSizeBuckets)
+	namespaceErrors := 0
+	for _, namespace := range namespaces {
+		summary, err := e.getNamespaceMetric(ctx, datastore.Store, namespace, ch)
+		if err != nil {
+			// the other namespaces would fail as well if the scrape is canceled
+			if ctx.Err() != nil {
+				return err
+			}
+			// a single configured namespace has to exist
+			if e.config.DatastoreNamespace != "" {
+				return fmt.Errorf("namespace %q does not exist or is not readable: %w", namespace, err)
+			}
+			log.Printf("WARN: Skipping namespace %q of datastore %s: %s", namespace, datastore.Store, err)
+			namespaceErrors++
+			continue
+		}
+		newestSnapshot = max(newestSnapshot, summary.newestSnapshot)
+		sizes.merge(summary.sizes)
+		*snapshotTotal += summary.snapshotCount
+	}
+	ch <- prometheus.MustNewConstMetric(
+		e.metrics.namespace_scrape_errors, prometheus.GaugeValue, float64(namespaceErrors), datastore.Store,
+	)
+
+	// set snapshot size histogram, built per scrape from all snapshots of the datastore
+	ch <- prometheus.MustNewConstHistogram(
+		e.metrics.snapshot_size_bytes, sizes.count, sizes.sum, sizes.buckets, datastore.Store,
+	)
+
+	// set stale metric, a datastore without any snapshot is stale as well
+	stale := 0
+	if time.Since(time.Unix(newestSnapshot, 0)) > e.config.StaleThreshold {
+		stale = 1
+	}
+	ch <- prometheus.MustNewConstMetric(
+		e.metrics.datastore_stale, prometheus.GaugeValue, float64(stale), datastore.Store,
+	)
+
+	return nil
+}
+
+// namespaceSummary is returned by getNamespaceMetric to derive datastore metrics across all namespaces
+type namespaceSummary struct {
+	snapshotCount  int
+	newestSnapshot int64
+	sizes          sizeHistogram
+}
+
+// sizeHistogram counts snapshot sizes in the buckets of Config.SnapshotSizeBuckets, the counts are cumulative
+type sizeHistogram struct {
+	count   uint64
+	sum     float64
+	buckets map[float64]uint64
+}
+
+// newSizeHistogram returns an empty histogram with all bounds, so buckets without any snapshot are reported as well.
+func newSizeHistogram(bounds []float64) sizeHistogram {
+	buckets := make(map[float64]uint64, len(bounds))
+	for _, bound := range bounds {
+		buckets[bound] = 0
+	}
+	return sizeHistogram{buckets: buckets}
+}
+
+func (h *sizeHistogram) observe(size float64) {
+	h.count++
+	h.sum += size
+	for bound := range h.buckets {
+		if size <= bound {
+			h.buckets[bound]++
+		}
+	}
+}
+
+func (h *sizeHistogram) merge(other sizeHistogram) {
+	h.count += other.count
+	h.sum += other.sum
+	for bound, count := range other.buckets {
+		h.buckets[bound] += count
+	}
+}
+
+// datastoreAvailable checks if the status of the datastore can be read. Errors of the status api
+// (except for missing permissions) are not returned, they mean the datastore is not available.
+func (e *Exporter) datastoreAvailable(ctx context.Context, datastore Datastore) (bool, error) {
+	if datastore.Error != "" || datastore.MountStatus == "notmounted" {
+		return false, nil
+	}
+	if datastore.statusRead {
+		return true, nil
+	}
+
+	err := e.apiDo(ctx, datastoreApi+"/{store}/status", []string{datastore.Store}, nil, func(io.Reader) error {
+		return nil
+	})
+	var statusErr *statusError
+	if errors.As(err, &statusErr) && statusErr.statusCode != http.StatusForbidden {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (e *Exporter) getNamespaceMetric(ctx context.Context, datastore string, namespace string, ch chan<- prometheus.Metric) (namespaceSummary, error) {
+	// debug
+	if e.config.Debug {
+		log.Printf("DEBUG: ----Namespace %s", namespace)
+	}
+
+	// get snapshots of datastore and aggregate them per vm in a single pass, without holding the list in memory
+	snapshotCount := 0
+	unverifiedCount := 0
+	verificationCount := map[string]int{"ok": 0, "failed": 0, "none": 0}
+	var oldestSnapshot int64
+	summary := namespaceSummary{sizes: newSizeHistogram(e.config.SnapshotSizeBuckets)}
+	typeCount := make(map[string]int)
+	ownerCount := make(map[string]int)
+	vmStats := make(map[string]*backupGroupStats)
+	err := e.apiDo(ctx, datastoreApi+"/{store}/snapshots", []string{datastore}, url.Values{"ns": {namespace}}, func(body io.Reader) error {
+		return decodeSnapshots(body, func(snapshot Snapshot) {
+			snapshotCount++
+			typeCount[snapshot.BackupType]++
+			if e.config.CollectOwner {
+				ownerCount[snapshot.Owner]++
+			}
+			if snapshot.Verification.State == "" || snapshot.Verification.State == "none" {
+				unverifiedCount++
+			}
+			switch snapshot.Verification.State {
+			case "ok", "failed":
+				verificationCount[snapshot.Verification.State]++
+			default:
+				verificationCount["none"]++
+			}
+
+			// get vm name from snapshot
+			vmID := snapshot.BackupID
+			stats, ok := vmStats[vmID]
+			if !ok {
+				stats = &backupGroupStats{}
+				vmStats[vmID] = stats
+			}
+			stats.vmName = snapshot.VMName
+			stats.count++
+
+			summary.newestSnapshot = max(summary.newestSnapshot, snapshot.BackupTime)
+			if snapshot.Size != nil {
+				summary.sizes.observe(float64(*snapshot.Size))
+			}
+			if oldestSnapshot == 0 || snapshot.BackupTime < oldestSnapshot {
+				oldestSnapshot = snapshot.BackupTime
+			}
+
+			// remember last snapshot with backupID
+			if snapshot.BackupTime > stats.lastTime {
+				stats.lastTime = snapshot.BackupTime
+				stats.lastVerify = snapshot.Verification.State
+			}
+		})
+	})
+	if err != nil {
+		return namespaceSummary{}, err
+	}
+
+	// set total snapshot metrics
+	ch <- prometheus.MustNewConstMetric(
+		e.metrics.snapshot_count, prometheus.GaugeValue, float64(snapshotCount), datastore, namespace,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		e.metrics.unverified_snapshot_count, prometheus.GaugeValue, float64(unverifiedCount), datastore, namespace,
+	)
+	for state, count := range verificationCount {
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.snapshot_verification_count, prometheus.GaugeValue, float64(count), datastore, namespace, state,
+		)
+	}
+
+	// set the retention depth of the namespace, if it has any snapshots
+	if snapshotCount > 0 {
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.namespace_oldest_snapshot_timestamp, prometheus.GaugeValue, float64(oldestSnapshot), datastore, namespace,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.namespace_newest_snapshot_timestamp, prometheus.GaugeValue, float64(summary.newestSnapshot), datastore, namespace,
+		)
+	}
+
+	// set snapshot metrics per backup type
+	for backupType, count := range typeCount {
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.snapshot_count_by_type, prometheus.GaugeValue, float64(count), datastore, namespace, backupType,
+		)
+	}
+
+	// set snapshot metrics per owner, limited like the metrics per vm
+	if e.config.MaxVMSeries > 0 && len(ownerCount) > e.config.MaxVMSeries {
+		log.Printf("WARN: Datastore %s namespace %q has %d owners (more than %d), skipping metrics per owner", datastore, namespace, len(ownerCount), e.config.MaxVMSeries)
+		clear(ownerCount)
+	}
+	for owner, count := range ownerCount {
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.snapshot_count_by_owner, prometheus.GaugeValue, float64(count), datastore, namespace, owner,
+		)
+	}
+
+	// skip the metrics per vm if there are too many backup groups, snapshot_count still holds the total
+	truncated := e.config.MaxVMSeries > 0 && len(vmStats) > e.config.MaxVMSeries
+	truncatedValue := 0
+	if truncated {
+		truncatedValue = 1
+		log.Printf("WARN: Datastore %s namespace %q has %d backup groups (more than %d), skipping metrics per vm", datastore, namespace, len(vmStats), e.config.MaxVMSeries)
+		clear(vmStats)
+	}
+	ch <- prometheus.MustNewConstMetric(
+		e.metrics.snapshot_vm_count_truncated, prometheus.GaugeValue, float64(truncatedValue), datastore, namespace,
+	)
+
+	// set snapshot metrics per vm
+	for vmID, stats := range vmStats {
+		// unmapped backup ids are used as name unchanged
+		name, ok := e.config.BackupIDNames[vmID]
+		if !ok {
+			name = vmID
+		}
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.snapshot_vm_count, prometheus.GaugeValue, float64(stats.count), datastore, namespace, vmID, stats.vmName, name,
+		)
+
+		lastVerifyBool := 0
+		if stats.lastVerify == "ok" {
+			lastVerifyBool = 1
+		}
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.snapshot_vm_last_timestamp, prometheus.GaugeValue, float64(stats.lastTime), datastore, namespace, vmID, stats.vmName, name,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.snapshot_vm_last_verify, prometheus.GaugeValue, float64(lastVerifyBool), datastore, namespace, vmID, stats.vmName, name,
+		)
+	}
+
+	summary.snapshotCount = snapshotCount
+	return summary, nil
+}
+
+// latestRRDValue returns the value of field of the most recent rrd sample in which it is not null.
+func latestRRDValue(response RRDResponse, field string) (float64, bool) {
+	var lastTime float64
+	var lastValue float64
+	found := false
+	for _, sample := range response.Data {
+		value := sample[field]
+		sampleTime := sample["time"]
+		if value == nil || sampleTime == nil {
+			continue
+		}
+		if !found || *sampleTime > lastTime {
+			lastTime = *sampleTime
+			lastValue = *value
+			found = true
+		}
+	}
+	return lastValue, found
+}
+
+// latestHistoryValue returns the most recent value of the usage history of a datastore which is not null.
+func latestHistoryValue(history []*float64) (float64, bool) {
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i] != nil {
+			return *history[i], true
+		}
+	}
+	return 0, false
+}
+
+// decodeSnapshots decodes the response of the snapshots api and calls fn for each snapshot
+// of the data array, so only one snapshot is held in memory at a time. Like apiGet, it returns
+// errNoData if the data array is missing or null, which must not be mistaken for no snapshots.
+func decodeSnapshots(r io.Reader, fn func(Snapshot)) error {
+	decoder := json.NewDecoder(r)
+
+	// opening brace of the response object, a response without a body has no snapshots
+	if err := expectDelim(decoder, '{'); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		return err
+	}
+	hasData := false
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+
+		// skip all other fields of the response, but errors
+		if key != "data" {
+			var skip json.RawMessage
+			if err := decoder.Decode(&skip); err != nil {
+				return err
+			}
+			if key == "errors" {
+				if err := responseErrors(skip); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		if token == nil {
+			return errNoData
+		}
+		if token != json.Delim('[') {
+			return fmt.Errorf("ERROR: Unexpected json token %v, expected [", token)
+		}
+		for decoder.More() {
+			var snapshot Snapshot
+			if err := decoder.Decode(&snapshot); err != nil {
+				return err
+			}
+			fn(snapshot)
+		}
+		if err := expectDelim(decoder, ']'); err != nil {
+			return err
+		}
+		hasData = true
+	}
+	if err := expectDelim(decoder, '}'); err != nil {
+		return err
+	}
+	if !hasData {
+		return errNoData
+	}
+	return nil
+}
+
+// expectDelim reads the next json token and returns an error if it is not the delimiter delim.
+func expectDelim(decoder *json.Decoder, delim json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("ERROR: Unexpected json token %v, expected %v", token, delim)
+	}
+	return nil
+}
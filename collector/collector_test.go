@@ -0,0 +1,1054 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testAuthorization is the Authorization header the mock PBS expects, see newTestExporter.
+const testAuthorization = "PBSAPIToken=root@pam!pbs-exporter:secret"
+
+// mockResponse is a canned response of the mock PBS, the status code is 200 if it is 0.
+type mockResponse struct {
+	status int
+	body   string
+}
+
+// mockFixtures returns the responses of a PBS with the datastore store1, which has a root namespace
+// and the namespace team-a, and the node localhost. The map can be changed by the tests.
+func mockFixtures() map[string]mockResponse {
+	return map[string]mockResponse{
+		"/api2/json/version": {body: `{"data":{"release":"3.2","repoid":"abc123","version":"3.2.2"}}`},
+		"/api2/json/status/datastore-usage": {body: `{"data":[
+			{"store":"store1","total":1000,"used":400,"avail":600}
+		]}`},
+		"/api2/json/config/datastore": {body: `{"data":[
+			{"name":"store1","path":"/mnt/store1","gc-schedule":"daily"}
+		]}`},
+		"/api2/json/config/datastore/store1":        {body: `{"data":{"name":"store1","path":"/mnt/store1","gc-schedule":"daily"}}`},
+		"/api2/json/admin/datastore/store1/status":  {body: `{"data":{"total":1000,"used":400,"avail":600}}`},
+		"/api2/json/admin/datastore/store1/rrddata": {body: `{"data":[{"time":60,"read_bytes":10,"write_bytes":20}]}`},
+		"/api2/json/admin/datastore/store1/gc":      {body: `{"data":{"disk-chunks":42}}`},
+		"/api2/json/admin/datastore/store1/namespace": {body: `{"data":[
+			{"ns":""},{"ns":"team-a"}
+		]}`},
+		"/api2/json/admin/datastore/store1/snapshots?ns=": {body: `{"data":[
+			{"backup-type":"vm","backup-id":"101","backup-time":1700000000,"owner":"root@pam","size":5000000,"comment":"web","verification":{"state":"ok"}},
+			{"backup-type":"vm","backup-id":"101","backup-time":1700086400,"owner":"root@pam","size":6000000,"comment":"web"}
+		]}`},
+		"/api2/json/admin/datastore/store1/snapshots?ns=team-a": {body: `{"data":[
+			{"backup-type":"ct","backup-id":"200","backup-time":1700000000,"owner":"root@pam","size":2000000000,"comment":"db","verification":{"state":"failed"}}
+		]}`},
+		"/api2/json/config/verify": {body: `{"data":[{"id":"verify1","schedule":"daily"}]}`},
+		"/api2/json/config/prune":  {body: `{"data":[{"id":"prune1","schedule":"daily","disable":true}]}`},
+		"/api2/json/config/sync":   {body: `{"data":[]}`},
+		"/api2/json/nodes":         {body: `{"data":[{"node":"localhost"}]}`},
+		"/api2/json/nodes/localhost/status": {body: `{"data":{
+			"cpu":0.25,
+			"memory":{"free":3000,"total":8000,"used":5000},
+			"swap":{"free":1000,"total":1000,"used":0},
+			"root":{"avail":700,"total":1000,"used":300},
+			"loadavg":[0.5,0.4,0.3],
+			"uptime":3600,
+			"wait":0.01
+		}}`},
+		"/api2/json/nodes/localhost/rrd":        {body: `{"data":[{"time":60,"netin":100,"netout":200}]}`},
+		"/api2/json/nodes/localhost/disks/list": {body: `{"data":[{"name":"sda","health":"PASSED"}]}`},
+		"/api2/json/nodes/localhost/tasks":      {body: `{"data":[]}`},
+	}
+}
+
+// rebaseFixtures returns the fixtures with DefaultAPIBasePath replaced by basePath in their paths.
+func rebaseFixtures(fixtures map[string]mockResponse, basePath string) map[string]mockResponse {
+	rebased := make(map[string]mockResponse, len(fixtures))
+	for path, response := range fixtures {
+		rebased[basePath+strings.TrimPrefix(path, DefaultAPIBasePath)] = response
+	}
+	return rebased
+}
+
+// newMockPBS returns a server answering with the fixtures, see mockPBSHandler.
+func newMockPBS(t testing.TB, fixtures map[string]mockResponse) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(mockPBSHandler(fixtures))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// mockPBSHandler answers with the fixtures, which are looked up by the path and query of the request
+// first and by its path second. Requests with another Authorization header than testAuthorization
+// are rejected with 401, unknown paths with 404.
+func mockPBSHandler(fixtures map[string]mockResponse) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != testAuthorization {
+			http.Error(w, `{"data":null,"message":"authentication failure"}`, http.StatusUnauthorized)
+			return
+		}
+		response, ok := fixtures[r.URL.Path+"?"+r.URL.RawQuery]
+		if !ok {
+			response, ok = fixtures[r.URL.Path]
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if response.status == 0 {
+			response.status = http.StatusOK
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(response.status)
+		_, _ = w.Write([]byte(response.body))
+	})
+}
+
+// newTestExporter returns an exporter of endpoint with the credentials expected by the mock PBS,
+// modify changes the default config if it is not nil.
+func newTestExporter(t testing.TB, endpoint string, modify func(*Config)) *Exporter {
+	t.Helper()
+	config := DefaultConfig()
+	config.Endpoint = endpoint
+	config.Username = "root@pam"
+	config.APIToken = "secret"
+	config.APITokenName = "pbs-exporter"
+	if modify != nil {
+		modify(&config)
+	}
+	exporter, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return exporter
+}
+
+func TestCollect(t *testing.T) {
+	server := newMockPBS(t, mockFixtures())
+	exporter := newTestExporter(t, server.URL, func(config *Config) {
+		config.CollectDisks = true
+	})
+
+	expected := `
+# HELP pbs_up Was the last query of PBS successful.
+# TYPE pbs_up gauge
+pbs_up 1
+# HELP pbs_reachable Did PBS respond to any request of the last query, also with an error status.
+# TYPE pbs_reachable gauge
+pbs_reachable 1
+# HELP pbs_version Version of the PBS installation.
+# TYPE pbs_version gauge
+pbs_version{release="3.2",repoid="abc123",version="3.2.2"} 1
+# HELP pbs_datastore_count The number of datastores.
+# TYPE pbs_datastore_count gauge
+pbs_datastore_count 1
+# HELP pbs_datastore_info Information about the datastore configuration (always 1).
+# TYPE pbs_datastore_info gauge
+pbs_datastore_info{comment="",datastore="store1",path="/mnt/store1",type="local"} 1
+# HELP pbs_size The size of the underlying storage in bytes.
+# TYPE pbs_size gauge
+pbs_size{datastore="store1"} 1000
+# HELP pbs_used The used bytes of the underlying storage.
+# TYPE pbs_used gauge
+pbs_used{datastore="store1"} 400
+# HELP pbs_available The available bytes of the underlying storage.
+# TYPE pbs_available gauge
+pbs_available{datastore="store1"} 600
+# HELP pbs_datastore_used_fraction The used fraction (0-1) of the underlying storage.
+# TYPE pbs_datastore_used_fraction gauge
+pbs_datastore_used_fraction{datastore="store1"} 0.4
+# HELP pbs_datastore_read_bytes The read rate of the datastore in bytes per second (latest rrd sample).
+# TYPE pbs_datastore_read_bytes gauge
+pbs_datastore_read_bytes{datastore="store1"} 10
+# HELP pbs_datastore_chunk_count The number of chunks of the datastore, counted by the last garbage collection.
+# TYPE pbs_datastore_chunk_count gauge
+pbs_datastore_chunk_count{datastore="store1"} 42
+# HELP pbs_namespace_count The number of namespaces of a datastore, including the root namespace.
+# TYPE pbs_namespace_count gauge
+pbs_namespace_count{datastore="store1"} 2
+# HELP pbs_snapshot_count The total number of backups.
+# TYPE pbs_snapshot_count gauge
+pbs_snapshot_count{datastore="store1",namespace=""} 2
+pbs_snapshot_count{datastore="store1",namespace="team-a"} 1
+# HELP pbs_total_snapshot_count The total number of backups of all datastores and namespaces.
+# TYPE pbs_total_snapshot_count gauge
+pbs_total_snapshot_count 3
+# HELP pbs_snapshot_verification_count The number of backups by the state of their last verification (ok, failed or none).
+# TYPE pbs_snapshot_verification_count gauge
+pbs_snapshot_verification_count{datastore="store1",namespace="",state="failed"} 0
+pbs_snapshot_verification_count{datastore="store1",namespace="",state="none"} 1
+pbs_snapshot_verification_count{datastore="store1",namespace="",state="ok"} 1
+pbs_snapshot_verification_count{datastore="store1",namespace="team-a",state="failed"} 1
+pbs_snapshot_verification_count{datastore="store1",namespace="team-a",state="none"} 0
+pbs_snapshot_verification_count{datastore="store1",namespace="team-a",state="ok"} 0
+# HELP pbs_snapshot_vm_count The total number of backups per VM.
+# TYPE pbs_snapshot_vm_count gauge
+pbs_snapshot_vm_count{datastore="store1",name="101",namespace="",vm_id="101",vm_name="web"} 2
+pbs_snapshot_vm_count{datastore="store1",name="200",namespace="team-a",vm_id="200",vm_name="db"} 1
+# HELP pbs_snapshot_vm_last_timestamp The timestamp of the last backup of a VM.
+# TYPE pbs_snapshot_vm_last_timestamp gauge
+pbs_snapshot_vm_last_timestamp{datastore="store1",name="101",namespace="",vm_id="101",vm_name="web"} 1.7000864e+09
+pbs_snapshot_vm_last_timestamp{datastore="store1",name="200",namespace="team-a",vm_id="200",vm_name="db"} 1.7e+09
+# HELP pbs_configured_jobs The number of configured jobs by type (gc, verify, prune, sync).
+# TYPE pbs_configured_jobs gauge
+pbs_configured_jobs{type="gc"} 1
+pbs_configured_jobs{type="prune"} 1
+pbs_configured_jobs{type="sync"} 0
+pbs_configured_jobs{type="verify"} 1
+# HELP pbs_enabled_jobs The number of jobs with a schedule which are not disabled by type (gc, verify, prune, sync).
+# TYPE pbs_enabled_jobs gauge
+pbs_enabled_jobs{type="gc"} 1
+pbs_enabled_jobs{type="prune"} 0
+pbs_enabled_jobs{type="sync"} 0
+pbs_enabled_jobs{type="verify"} 1
+# HELP pbs_host_cpu_usage The CPU usage of the host.
+# TYPE pbs_host_cpu_usage gauge
+pbs_host_cpu_usage{node="localhost"} 0.25
+# HELP pbs_host_memory_used The used memory of the host.
+# TYPE pbs_host_memory_used gauge
+pbs_host_memory_used{node="localhost"} 5000
+# HELP pbs_host_load1 The load for 1 minute of the host.
+# TYPE pbs_host_load1 gauge
+pbs_host_load1{node="localhost"} 0.5
+# HELP pbs_host_net_in_bytes The inbound network traffic of the host in bytes per second (latest rrd sample).
+# TYPE pbs_host_net_in_bytes gauge
+pbs_host_net_in_bytes{node="localhost"} 100
+# HELP pbs_disk_health The SMART health of the disk (1 = passed, 0 = failed, -1 = unknown).
+# TYPE pbs_disk_health gauge
+pbs_disk_health{device="sda",node="localhost"} 1
+`
+	err := testutil.CollectAndCompare(exporter, strings.NewReader(expected),
+		"pbs_up", "pbs_reachable", "pbs_version", "pbs_datastore_count", "pbs_datastore_info",
+		"pbs_size", "pbs_used", "pbs_available", "pbs_datastore_used_fraction", "pbs_datastore_read_bytes",
+		"pbs_datastore_chunk_count", "pbs_namespace_count", "pbs_snapshot_count", "pbs_total_snapshot_count",
+		"pbs_snapshot_verification_count", "pbs_snapshot_vm_count", "pbs_snapshot_vm_last_timestamp",
+		"pbs_configured_jobs", "pbs_enabled_jobs", "pbs_host_cpu_usage", "pbs_host_memory_used",
+		"pbs_host_load1", "pbs_host_net_in_bytes", "pbs_disk_health",
+	)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectEmptyDatastore(t *testing.T) {
+	fixtures := mockFixtures()
+	fixtures["/api2/json/admin/datastore/store1/namespace"] = mockResponse{body: `{"data":[{"ns":""}]}`}
+	fixtures["/api2/json/admin/datastore/store1/snapshots?ns="] = mockResponse{body: `{"data":[]}`}
+	server := newMockPBS(t, fixtures)
+	exporter := newTestExporter(t, server.URL, nil)
+
+	expected := `
+# HELP pbs_up Was the last query of PBS successful.
+# TYPE pbs_up gauge
+pbs_up 1
+# HELP pbs_snapshot_count The total number of backups.
+# TYPE pbs_snapshot_count gauge
+pbs_snapshot_count{datastore="store1",namespace=""} 0
+# HELP pbs_total_snapshot_count The total number of backups of all datastores and namespaces.
+# TYPE pbs_total_snapshot_count gauge
+pbs_total_snapshot_count 0
+# HELP pbs_datastore_stale Is the newest snapshot of the datastore older than the stale threshold (or there is none).
+# TYPE pbs_datastore_stale gauge
+pbs_datastore_stale{datastore="store1"} 1
+# HELP pbs_snapshot_size_bytes The distribution of the backup sizes of the datastore.
+# TYPE pbs_snapshot_size_bytes histogram
+pbs_snapshot_size_bytes_bucket{datastore="store1",le="1e+06"} 0
+pbs_snapshot_size_bytes_bucket{datastore="store1",le="1e+07"} 0
+pbs_snapshot_size_bytes_bucket{datastore="store1",le="1e+08"} 0
+pbs_snapshot_size_bytes_bucket{datastore="store1",le="1e+09"} 0
+pbs_snapshot_size_bytes_bucket{datastore="store1",le="1e+10"} 0
+pbs_snapshot_size_bytes_bucket{datastore="store1",le="1e+11"} 0
+pbs_snapshot_size_bytes_bucket{datastore="store1",le="1e+12"} 0
+pbs_snapshot_size_bytes_bucket{datastore="store1",le="+Inf"} 0
+pbs_snapshot_size_bytes_sum{datastore="store1"} 0
+pbs_snapshot_size_bytes_count{datastore="store1"} 0
+`
+	err := testutil.CollectAndCompare(exporter, strings.NewReader(expected),
+		"pbs_up", "pbs_snapshot_count", "pbs_total_snapshot_count", "pbs_datastore_stale", "pbs_snapshot_vm_count",
+		"pbs_snapshot_size_bytes",
+	)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectNoDatastores(t *testing.T) {
+	fixtures := mockFixtures()
+	fixtures[datastoreUsageApi] = mockResponse{body: `{"data":[]}`}
+	server := newMockPBS(t, fixtures)
+	exporter := newTestExporter(t, server.URL, nil)
+
+	// the list is filtered by the privileges of the token, an empty list is not an error
+	expected := `
+# HELP pbs_up Was the last query of PBS successful.
+# TYPE pbs_up gauge
+pbs_up 1
+# HELP pbs_datastore_count The number of datastores.
+# TYPE pbs_datastore_count gauge
+pbs_datastore_count 0
+# HELP pbs_total_snapshot_count The total number of backups of all datastores and namespaces.
+# TYPE pbs_total_snapshot_count gauge
+pbs_total_snapshot_count 0
+`
+	err := testutil.CollectAndCompare(exporter, strings.NewReader(expected),
+		"pbs_up", "pbs_datastore_count", "pbs_total_snapshot_count", "pbs_size", "pbs_snapshot_count",
+	)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectSnapshotSizeBuckets(t *testing.T) {
+	fixtures := mockFixtures()
+	fixtures["/api2/json/admin/datastore/store1/namespace"] = mockResponse{body: `{"data":[{"ns":""}]}`}
+	fixtures["/api2/json/admin/datastore/store1/snapshots?ns="] = mockResponse{body: `{"data":[
+		{"backup-type":"vm","backup-id":"101","backup-time":1700000000,"size":5000000}
+	]}`}
+	server := newMockPBS(t, fixtures)
+	exporter := newTestExporter(t, server.URL, nil)
+
+	// the buckets below the size are reported with a count of 0
+	expected := `
+# HELP pbs_snapshot_size_bytes The distribution of the backup sizes of the datastore.
+# TYPE pbs_snapshot_size_bytes histogram
+pbs_snapshot_size_bytes_bucket{datastore="store1",le="1e+06"} 0
+pbs_snapshot_size_bytes_bucket{datastore="store1",le="1e+07"} 1
+pbs_snapshot_size_bytes_bucket{datastore="store1",le="1e+08"} 1
+pbs_snapshot_size_bytes_bucket{datastore="store1",le="1e+09"} 1
+pbs_snapshot_size_bytes_bucket{datastore="store1",le="1e+10"} 1
+pbs_snapshot_size_bytes_bucket{datastore="store1",le="1e+11"} 1
+pbs_snapshot_size_bytes_bucket{datastore="store1",le="1e+12"} 1
+pbs_snapshot_size_bytes_bucket{datastore="store1",le="+Inf"} 1
+pbs_snapshot_size_bytes_sum{datastore="store1"} 5e+06
+pbs_snapshot_size_bytes_count{datastore="store1"} 1
+`
+	err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "pbs_snapshot_size_bytes")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectDatastoreBeingDeleted(t *testing.T) {
+	fixtures := mockFixtures()
+	fixtures["/api2/json/admin/datastore/store1/namespace"] = mockResponse{
+		status: http.StatusBadRequest,
+		body:   `{"data":null,"message":"datastore is being deleted"}`,
+	}
+	server := newMockPBS(t, fixtures)
+	exporter := newTestExporter(t, server.URL, nil)
+
+	// the datastore is skipped without failing the collection
+	expected := `
+# HELP pbs_up Was the last query of PBS successful.
+# TYPE pbs_up gauge
+pbs_up 1
+# HELP pbs_total_snapshot_count The total number of backups of all datastores and namespaces.
+# TYPE pbs_total_snapshot_count gauge
+pbs_total_snapshot_count 0
+`
+	err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "pbs_up", "pbs_snapshot_count", "pbs_total_snapshot_count")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectBadRequest(t *testing.T) {
+	fixtures := mockFixtures()
+	fixtures["/api2/json/admin/datastore/store1/namespace"] = mockResponse{
+		status: http.StatusBadRequest,
+		body:   `{"data":null,"message":"parameter verification failed"}`,
+	}
+	server := newMockPBS(t, fixtures)
+	exporter := newTestExporter(t, server.URL, nil)
+
+	expected := `
+# HELP pbs_up Was the last query of PBS successful.
+# TYPE pbs_up gauge
+pbs_up 0
+`
+	err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "pbs_up")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectIPv6Endpoint(t *testing.T) {
+	listener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("ipv6 is not available: %s", err)
+	}
+	fixtures := mockFixtures()
+	fixtures["/api2/json/admin/datastore/store1/namespace"] = mockResponse{body: `{"data":[{"ns":"team-a/prod"}]}`}
+	fixtures["/api2/json/admin/datastore/store1/snapshots?ns=team-a%2Fprod"] = mockResponse{body: `{"data":[
+		{"backup-type":"vm","backup-id":"101","backup-time":1700000000,"size":5000000}
+	]}`}
+	server := httptest.NewUnstartedServer(mockPBSHandler(fixtures))
+	server.Listener.Close()
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+	if !strings.HasPrefix(server.URL, "http://[::1]:") {
+		t.Fatalf("expected an ipv6 literal url, got %s", server.URL)
+	}
+	exporter := newTestExporter(t, server.URL, nil)
+
+	expected := `
+# HELP pbs_up Was the last query of PBS successful.
+# TYPE pbs_up gauge
+pbs_up 1
+# HELP pbs_snapshot_count The total number of backups.
+# TYPE pbs_snapshot_count gauge
+pbs_snapshot_count{datastore="store1",namespace="team-a/prod"} 1
+`
+	err = testutil.CollectAndCompare(exporter, strings.NewReader(expected), "pbs_up", "pbs_snapshot_count")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectAPIBasePath(t *testing.T) {
+	server := newMockPBS(t, rebaseFixtures(mockFixtures(), "/custom/json"))
+	exporter := newTestExporter(t, server.URL, func(config *Config) {
+		config.APIBasePath = "/custom/json/"
+	})
+
+	expected := `
+# HELP pbs_up Was the last query of PBS successful.
+# TYPE pbs_up gauge
+pbs_up 1
+# HELP pbs_total_snapshot_count The total number of backups of all datastores and namespaces.
+# TYPE pbs_total_snapshot_count gauge
+pbs_total_snapshot_count 3
+`
+	err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "pbs_up", "pbs_total_snapshot_count")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectEndpointPath(t *testing.T) {
+	server := newMockPBS(t, rebaseFixtures(mockFixtures(), "/pbs"+DefaultAPIBasePath))
+	exporter := newTestExporter(t, server.URL+"/pbs/", nil)
+
+	expected := `
+# HELP pbs_up Was the last query of PBS successful.
+# TYPE pbs_up gauge
+pbs_up 1
+# HELP pbs_total_snapshot_count The total number of backups of all datastores and namespaces.
+# TYPE pbs_total_snapshot_count gauge
+pbs_total_snapshot_count 3
+`
+	err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "pbs_up", "pbs_total_snapshot_count")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectNumbersAsStrings(t *testing.T) {
+	fixtures := mockFixtures()
+	fixtures[datastoreUsageApi] = mockResponse{body: `{"data":[
+		{"store":"store1","total":"1000","used":"400","avail":"600"}
+	]}`}
+	fixtures["/api2/json/nodes/localhost/status"] = mockResponse{body: `{"data":{
+		"cpu":"0.25",
+		"memory":{"free":"3000","total":"8000","used":"5000"},
+		"swap":{"free":"1000","total":"1000","used":"0"},
+		"root":{"avail":"700","total":"1000","used":"300"},
+		"loadavg":["0.5","0.4","0.3"],
+		"uptime":"3600",
+		"wait":"0.01"
+	}}`}
+	server := newMockPBS(t, fixtures)
+	exporter := newTestExporter(t, server.URL, nil)
+
+	expected := `
+# HELP pbs_up Was the last query of PBS successful.
+# TYPE pbs_up gauge
+pbs_up 1
+# HELP pbs_size The size of the underlying storage in bytes.
+# TYPE pbs_size gauge
+pbs_size{datastore="store1"} 1000
+# HELP pbs_available The available bytes of the underlying storage.
+# TYPE pbs_available gauge
+pbs_available{datastore="store1"} 600
+# HELP pbs_host_cpu_usage The CPU usage of the host.
+# TYPE pbs_host_cpu_usage gauge
+pbs_host_cpu_usage{node="localhost"} 0.25
+# HELP pbs_host_memory_total The total memory of the host.
+# TYPE pbs_host_memory_total gauge
+pbs_host_memory_total{node="localhost"} 8000
+# HELP pbs_host_load1 The load for 1 minute of the host.
+# TYPE pbs_host_load1 gauge
+pbs_host_load1{node="localhost"} 0.5
+`
+	err := testutil.CollectAndCompare(exporter, strings.NewReader(expected),
+		"pbs_up", "pbs_size", "pbs_available", "pbs_host_cpu_usage", "pbs_host_memory_total", "pbs_host_load1",
+	)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectAuthFailure(t *testing.T) {
+	server := newMockPBS(t, mockFixtures())
+	exporter := newTestExporter(t, server.URL, func(config *Config) {
+		config.APIToken = "wrong"
+	})
+
+	// PBS responded, but the collection failed
+	expected := `
+# HELP pbs_up Was the last query of PBS successful.
+# TYPE pbs_up gauge
+pbs_up 0
+# HELP pbs_reachable Did PBS respond to any request of the last query, also with an error status.
+# TYPE pbs_reachable gauge
+pbs_reachable 1
+`
+	err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "pbs_up", "pbs_reachable", "pbs_version")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectUnreachable(t *testing.T) {
+	server := newMockPBS(t, mockFixtures())
+	server.Close()
+	exporter := newTestExporter(t, server.URL, nil)
+
+	expected := `
+# HELP pbs_up Was the last query of PBS successful.
+# TYPE pbs_up gauge
+pbs_up 0
+# HELP pbs_reachable Did PBS respond to any request of the last query, also with an error status.
+# TYPE pbs_reachable gauge
+pbs_reachable 0
+`
+	err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "pbs_up", "pbs_reachable")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// cachedTransport marks all responses as served from a cache.
+type cachedTransport struct{}
+
+func (cachedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err == nil {
+		resp.Header.Set(CachedResponseHeader, "hit")
+	}
+	return resp, err
+}
+
+func TestCollectCachedResponses(t *testing.T) {
+	server := newMockPBS(t, mockFixtures())
+	exporter := newTestExporter(t, server.URL, func(config *Config) {
+		config.Client = &http.Client{Transport: cachedTransport{}}
+	})
+
+	// pbs_reachable is not reported, as PBS was not asked
+	expected := `
+# HELP pbs_up Was the last query of PBS successful.
+# TYPE pbs_up gauge
+pbs_up 1
+`
+	err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "pbs_up", "pbs_reachable")
+	if err != nil {
+		t.Error(err)
+	}
+	if count := testutil.CollectAndCount(exporter.config.Stats, "pbs_api_requests_total"); count != 0 {
+		t.Errorf("expected no api requests for cached responses, got %d series", count)
+	}
+}
+
+// countingTransport counts the requests by path.
+type countingTransport struct {
+	mu       sync.Mutex
+	requests map[string]int
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.requests[req.URL.Path]++
+	t.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestCollectDatastoreConfigOnce(t *testing.T) {
+	server := newMockPBS(t, mockFixtures())
+	transport := &countingTransport{requests: make(map[string]int)}
+	exporter := newTestExporter(t, server.URL, func(config *Config) {
+		config.Client = &http.Client{Transport: transport}
+	})
+
+	if _, err := testutil.CollectAndLint(exporter); err != nil {
+		t.Fatal(err)
+	}
+	if count := transport.requests[datastoreConfigApi]; count != 1 {
+		t.Errorf("expected a single request of the datastore config, got %d", count)
+	}
+}
+
+func TestCollectFailingDatastore(t *testing.T) {
+	fixtures := mockFixtures()
+	fixtures[datastoreUsageApi] = mockResponse{body: `{"data":[
+		{"store":"store2","total":2000,"used":500,"avail":1500},
+		{"store":"store1","total":1000,"used":400,"avail":600}
+	]}`}
+	fixtures["/api2/json/admin/datastore/store2/status"] = mockResponse{body: `{"data":{"total":2000,"used":500,"avail":1500}}`}
+	fixtures["/api2/json/admin/datastore/store2/rrddata"] = mockResponse{status: http.StatusInternalServerError, body: `{"data":null}`}
+	server := newMockPBS(t, fixtures)
+	exporter := newTestExporter(t, server.URL, nil)
+
+	// the failing datastore store2 is listed first, store1 is still collected
+	expected := `
+# HELP pbs_up Was the last query of PBS successful.
+# TYPE pbs_up gauge
+pbs_up 0
+# HELP pbs_datastore_chunk_count The number of chunks of the datastore, counted by the last garbage collection.
+# TYPE pbs_datastore_chunk_count gauge
+pbs_datastore_chunk_count{datastore="store1"} 42
+`
+	err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "pbs_up", "pbs_datastore_chunk_count")
+	if err != nil {
+		t.Error(err)
+	}
+
+	ch := make(chan prometheus.Metric)
+	go func() {
+		for range ch {
+		}
+	}()
+	err = exporter.collectFromAPI(context.Background(), ch)
+	close(ch)
+	if err == nil || !strings.Contains(err.Error(), "datastore store2") {
+		t.Errorf("expected the error of datastore store2, got %v", err)
+	}
+}
+
+func TestCollectSingleDatastoreStatusOnce(t *testing.T) {
+	server := newMockPBS(t, mockFixtures())
+	transport := &countingTransport{requests: make(map[string]int)}
+	exporter := newTestExporter(t, server.URL, func(config *Config) {
+		config.Client = &http.Client{Transport: transport}
+		config.Datastore = "store1"
+	})
+
+	expected := `
+# HELP pbs_available The available bytes of the underlying storage.
+# TYPE pbs_available gauge
+pbs_available{datastore="store1"} 600
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "pbs_available"); err != nil {
+		t.Error(err)
+	}
+	if count := transport.requests["/api2/json/admin/datastore/store1/status"]; count != 1 {
+		t.Errorf("expected a single request of the datastore status, got %d", count)
+	}
+}
+
+func TestCollectSingleDatastoreOnly(t *testing.T) {
+	fixtures := mockFixtures()
+	fixtures[datastoreConfigApi] = mockResponse{body: `{"data":[
+		{"name":"store1","path":"/mnt/store1","gc-schedule":"daily"},
+		{"name":"store2","path":"/mnt/store2"}
+	]}`}
+	server := newMockPBS(t, fixtures)
+	transport := &countingTransport{requests: make(map[string]int)}
+	exporter := newTestExporter(t, server.URL, func(config *Config) {
+		config.Client = &http.Client{Transport: transport}
+		config.Datastore = "store1"
+	})
+
+	expected := `
+# HELP pbs_up Was the last query of PBS successful.
+# TYPE pbs_up gauge
+pbs_up 1
+# HELP pbs_datastore_info Information about the datastore configuration (always 1).
+# TYPE pbs_datastore_info gauge
+pbs_datastore_info{comment="",datastore="store1",path="/mnt/store1",type="local"} 1
+# HELP pbs_datastore_notify_configured Are notifications of job results configured for the datastore.
+# TYPE pbs_datastore_notify_configured gauge
+pbs_datastore_notify_configured{datastore="store1"} 0
+# HELP pbs_gc_schedule_info The configured garbage collection schedule of the datastore, none if there is no schedule (always 1).
+# TYPE pbs_gc_schedule_info gauge
+pbs_gc_schedule_info{datastore="store1",schedule="daily"} 1
+# HELP pbs_configured_jobs The number of configured jobs by type (gc, verify, prune, sync).
+# TYPE pbs_configured_jobs gauge
+pbs_configured_jobs{type="gc"} 1
+pbs_configured_jobs{type="prune"} 1
+pbs_configured_jobs{type="sync"} 0
+pbs_configured_jobs{type="verify"} 1
+`
+	err := testutil.CollectAndCompare(exporter, strings.NewReader(expected),
+		"pbs_up", "pbs_datastore_info", "pbs_datastore_notify_configured", "pbs_gc_schedule_info", "pbs_configured_jobs",
+	)
+	if err != nil {
+		t.Error(err)
+	}
+	for _, path := range []string{datastoreConfigApi, datastoreUsageApi} {
+		if count := transport.requests[path]; count != 0 {
+			t.Errorf("expected no request of %s, got %d", path, count)
+		}
+	}
+}
+
+func TestSetDatastoreInfoSingleDatastore(t *testing.T) {
+	exporter := newTestExporter(t, "https://pbs.example.com:8007", func(config *Config) {
+		config.Datastore = "store1"
+	})
+	response := &DatastoreConfigResponse{Data: []DatastoreConfig{{Name: "store1"}, {Name: "store2"}}}
+
+	ch := make(chan prometheus.Metric, 10)
+	exporter.setDatastoreInfo(ch, response)
+	close(ch)
+
+	// the info, notify and gc schedule metrics of store1
+	if len(ch) != 3 {
+		t.Errorf("expected the 3 metrics of store1, got %d", len(ch))
+	}
+}
+
+func TestCollectDisksDisabled(t *testing.T) {
+	server := newMockPBS(t, mockFixtures())
+	transport := &countingTransport{requests: make(map[string]int)}
+	exporter := newTestExporter(t, server.URL, func(config *Config) {
+		config.Client = &http.Client{Transport: transport}
+	})
+
+	if count := testutil.CollectAndCount(exporter, "pbs_disk_health"); count != 0 {
+		t.Errorf("expected no disk metrics, got %d", count)
+	}
+	if count := transport.requests["/api2/json/nodes/localhost/disks/list"]; count != 0 {
+		t.Errorf("expected no request of the disks, got %d", count)
+	}
+}
+
+func TestCollectDisksFailure(t *testing.T) {
+	fixtures := mockFixtures()
+	fixtures["/api2/json/nodes/localhost/disks/list"] = mockResponse{status: http.StatusInternalServerError, body: `{"data":null}`}
+	server := newMockPBS(t, fixtures)
+	exporter := newTestExporter(t, server.URL, func(config *Config) {
+		config.CollectDisks = true
+	})
+
+	// only the disk metrics are missing
+	expected := `
+# HELP pbs_up Was the last query of PBS successful.
+# TYPE pbs_up gauge
+pbs_up 1
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "pbs_up", "pbs_disk_health"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectPermissionDenied(t *testing.T) {
+	fixtures := mockFixtures()
+	fixtures["/api2/json/nodes"] = mockResponse{status: http.StatusForbidden, body: `{"data":null,"message":"permission check failed"}`}
+	server := newMockPBS(t, fixtures)
+	exporter := newTestExporter(t, server.URL, nil)
+
+	// the node metrics are skipped, the datastore metrics are still collected
+	expected := `
+# HELP pbs_up Was the last query of PBS successful.
+# TYPE pbs_up gauge
+pbs_up 1
+# HELP pbs_size The size of the underlying storage in bytes.
+# TYPE pbs_size gauge
+pbs_size{datastore="store1"} 1000
+`
+	err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "pbs_up", "pbs_size", "pbs_host_cpu_usage")
+	if err != nil {
+		t.Error(err)
+	}
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(exporter)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	denied := map[string]float64{}
+	for _, family := range families {
+		if family.GetName() != "pbs_api_permission_denied" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			denied[metric.GetLabel()[0].GetValue()] = metric.GetGauge().GetValue()
+		}
+	}
+	if denied[nodeApi] != 1 || denied[versionApi] != 0 || len(denied) < 2 {
+		t.Errorf("expected only the nodes api to be denied, got %v", denied)
+	}
+}
+
+func TestCollectMaxVMSeries(t *testing.T) {
+	fixtures := mockFixtures()
+	fixtures["/api2/json/admin/datastore/store1/snapshots?ns="] = mockResponse{body: `{"data":[
+		{"backup-type":"vm","backup-id":"101","backup-time":1700000000,"owner":"root@pam","size":5000000,"comment":"web"},
+		{"backup-type":"vm","backup-id":"102","backup-time":1700000000,"owner":"root@pam","size":5000000,"comment":"mail"}
+	]}`}
+	server := newMockPBS(t, fixtures)
+	exporter := newTestExporter(t, server.URL, func(config *Config) {
+		config.MaxVMSeries = 1
+	})
+
+	// the root namespace has 2 backup groups, team-a a single one
+	expected := `
+# HELP pbs_snapshot_count The total number of backups.
+# TYPE pbs_snapshot_count gauge
+pbs_snapshot_count{datastore="store1",namespace=""} 2
+pbs_snapshot_count{datastore="store1",namespace="team-a"} 1
+# HELP pbs_snapshot_vm_count The total number of backups per VM.
+# TYPE pbs_snapshot_vm_count gauge
+pbs_snapshot_vm_count{datastore="store1",name="200",namespace="team-a",vm_id="200",vm_name="db"} 1
+# HELP pbs_snapshot_vm_count_truncated Were the snapshot metrics per VM skipped, because the namespace has more backup groups than the max vm series.
+# TYPE pbs_snapshot_vm_count_truncated gauge
+pbs_snapshot_vm_count_truncated{datastore="store1",namespace=""} 1
+pbs_snapshot_vm_count_truncated{datastore="store1",namespace="team-a"} 0
+`
+	err := testutil.CollectAndCompare(exporter, strings.NewReader(expected),
+		"pbs_snapshot_count", "pbs_snapshot_vm_count", "pbs_snapshot_vm_count_truncated",
+	)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectOwnerLimit(t *testing.T) {
+	fixtures := mockFixtures()
+	fixtures["/api2/json/admin/datastore/store1/snapshots?ns="] = mockResponse{body: `{"data":[
+		{"backup-type":"vm","backup-id":"101","backup-time":1700000000,"owner":"root@pam","size":5000000},
+		{"backup-type":"vm","backup-id":"101","backup-time":1700086400,"owner":"root@pam","size":5000000},
+		{"backup-type":"vm","backup-id":"102","backup-time":1700000000,"owner":"backup@pbs","size":5000000}
+	]}`}
+	server := newMockPBS(t, fixtures)
+	exporter := newTestExporter(t, server.URL, func(config *Config) {
+		config.CollectOwner = true
+		config.MaxVMSeries = 1
+	})
+
+	// the root namespace has 2 owners, so its metrics per owner are skipped, the total is kept
+	expected := `
+# HELP pbs_snapshot_count The total number of backups.
+# TYPE pbs_snapshot_count gauge
+pbs_snapshot_count{datastore="store1",namespace=""} 3
+pbs_snapshot_count{datastore="store1",namespace="team-a"} 1
+# HELP pbs_snapshot_count_by_owner The total number of backups per owner of the backup group.
+# TYPE pbs_snapshot_count_by_owner gauge
+pbs_snapshot_count_by_owner{datastore="store1",namespace="team-a",owner="root@pam"} 1
+`
+	err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "pbs_snapshot_count", "pbs_snapshot_count_by_owner")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// without the limit all owners are reported
+	exporter = newTestExporter(t, server.URL, func(config *Config) {
+		config.CollectOwner = true
+	})
+	expected = `
+# HELP pbs_snapshot_count_by_owner The total number of backups per owner of the backup group.
+# TYPE pbs_snapshot_count_by_owner gauge
+pbs_snapshot_count_by_owner{datastore="store1",namespace="",owner="backup@pbs"} 1
+pbs_snapshot_count_by_owner{datastore="store1",namespace="",owner="root@pam"} 2
+pbs_snapshot_count_by_owner{datastore="store1",namespace="team-a",owner="root@pam"} 1
+`
+	err = testutil.CollectAndCompare(exporter, strings.NewReader(expected), "pbs_snapshot_count_by_owner")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectFailingNode(t *testing.T) {
+	fixtures := mockFixtures()
+	fixtures["/api2/json/nodes"] = mockResponse{body: `{"data":[{"node":"offline"},{"node":"localhost"},{"node":"broken"}]}`}
+	fixtures["/api2/json/nodes/offline/status"] = mockResponse{status: http.StatusServiceUnavailable, body: `{"data":null}`}
+	fixtures["/api2/json/nodes/broken/status"] = mockResponse{status: http.StatusInternalServerError, body: `{"data":null}`}
+	server := newMockPBS(t, fixtures)
+	exporter := newTestExporter(t, server.URL, nil)
+
+	// the node offline is listed before localhost, which is still collected
+	expected := `
+# HELP pbs_up Was the last query of PBS successful.
+# TYPE pbs_up gauge
+pbs_up 0
+# HELP pbs_host_cpu_usage The CPU usage of the host.
+# TYPE pbs_host_cpu_usage gauge
+pbs_host_cpu_usage{node="localhost"} 0.25
+`
+	err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "pbs_up", "pbs_host_cpu_usage")
+	if err != nil {
+		t.Error(err)
+	}
+
+	ch := make(chan prometheus.Metric)
+	go func() {
+		for range ch {
+		}
+	}()
+	err = exporter.getNodeMetrics(context.Background(), ch)
+	close(ch)
+	var statusErr *statusError
+	if !errors.As(err, &statusErr) {
+		t.Fatalf("expected a status error, got %v", err)
+	}
+	for _, node := range []string{"node offline", "node broken"} {
+		if !strings.Contains(err.Error(), node) {
+			t.Errorf("expected the error of %s, got %v", node, err)
+		}
+	}
+}
+
+// versionFixtures returns the fixtures of the responses which differ between the PBS versions,
+// the other responses are the same in all versions.
+func versionFixtures() map[string]map[string]mockResponse {
+	return map[string]map[string]mockResponse{
+		// no garbage collection schedule status, no notification mode and no removable datastores
+		"2.4": {
+			"/api2/json/version":                   {body: `{"data":{"release":"2.4","repoid":"a1b2c3","version":"2.4.7"}}`},
+			"/api2/json/admin/datastore/store1/gc": {body: `{"data":{"upid":null,"disk-chunks":42,"disk-bytes":4200,"index-data-bytes":8400,"still-bad":0}}`},
+		},
+		"3.2": {},
+		// removable datastores report their mount status
+		"3.4": {
+			"/api2/json/version": {body: `{"data":{"release":"3.4","repoid":"d4e5f6","version":"3.4.1"}}`},
+			"/api2/json/status/datastore-usage": {body: `{"data":[
+				{"store":"store1","total":1000,"used":400,"avail":600,"mount-status":"mounted"}
+			]}`},
+			"/api2/json/config/datastore": {body: `{"data":[
+				{"name":"store1","path":"/mnt/datastore/store1","gc-schedule":"daily","backing-device":"a1b2-c3d4","notification-mode":"notification-system"}
+			]}`},
+			"/api2/json/admin/datastore/store1/gc": {body: `{"data":{
+				"disk-chunks":42,"last-run-endtime":1700000000,"last-run-state":"ok","last-run-upid":"UPID:localhost:1:2:3:4:garbage_collection:store1:root@pam:",
+				"next-run":1700086400,"schedule":"daily"
+			}}`},
+		},
+	}
+}
+
+func TestCollectVersions(t *testing.T) {
+	for version, test := range map[string]struct {
+		version string
+		present []string
+		absent  []string
+	}{
+		"2.4": {version: `pbs_version{release="2.4",repoid="a1b2c3",version="2.4.7"}`, present: []string{"pbs_datastore_chunk_count"}, absent: []string{"pbs_gc_last_run_timestamp", "pbs_removable_datastore_mounted"}},
+		"3.2": {version: `pbs_version{release="3.2",repoid="abc123",version="3.2.2"}`, present: []string{"pbs_datastore_chunk_count"}, absent: []string{"pbs_gc_last_run_timestamp", "pbs_removable_datastore_mounted"}},
+		"3.4": {version: `pbs_version{release="3.4",repoid="d4e5f6",version="3.4.1"}`, present: []string{"pbs_datastore_chunk_count", "pbs_gc_last_run_timestamp", "pbs_removable_datastore_mounted"}},
+	} {
+		t.Run(version, func(t *testing.T) {
+			fixtures := mockFixtures()
+			for path, response := range versionFixtures()[version] {
+				fixtures[path] = response
+			}
+			server := newMockPBS(t, fixtures)
+			exporter := newTestExporter(t, server.URL, nil)
+
+			expected := `
+# HELP pbs_up Was the last query of PBS successful.
+# TYPE pbs_up gauge
+pbs_up 1
+# HELP pbs_version Version of the PBS installation.
+# TYPE pbs_version gauge
+` + test.version + ` 1
+`
+			if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "pbs_up", "pbs_version"); err != nil {
+				t.Error(err)
+			}
+			for _, name := range test.present {
+				if count := testutil.CollectAndCount(exporter, name); count == 0 {
+					t.Errorf("expected %s", name)
+				}
+			}
+			for _, name := range test.absent {
+				if count := testutil.CollectAndCount(exporter, name); count != 0 {
+					t.Errorf("unexpected %s", name)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeSnapshots(t *testing.T) {
+	count := 0
+	var size int64
+	err := decodeSnapshots(strings.NewReader(snapshotListFixture(1000)), func(snapshot Snapshot) {
+		count++
+		size += *snapshot.Size
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1000 {
+		t.Errorf("expected 1000 snapshots, got %d", count)
+	}
+	if size != 1000*1e9+999*1000/2 {
+		t.Errorf("unexpected total size %d", size)
+	}
+}
+
+func TestDecodeSnapshotsNoData(t *testing.T) {
+	for name, body := range map[string]string{
+		"null":    `{"data":null}`,
+		"missing": `{}`,
+		"message": `{"message":"datastore not found"}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := decodeSnapshots(strings.NewReader(body), func(Snapshot) {})
+			if !errors.Is(err, errNoData) {
+				t.Errorf("expected an error for the missing data, got %v", err)
+			}
+		})
+	}
+
+	// an empty list has no snapshots
+	if err := decodeSnapshots(strings.NewReader(`{"data":[]}`), func(Snapshot) {}); err != nil {
+		t.Errorf("unexpected error for an empty list: %s", err)
+	}
+}
+
+func TestCollectSnapshotsNoData(t *testing.T) {
+	fixtures := mockFixtures()
+	fixtures["/api2/json/admin/datastore/store1/snapshots?ns="] = mockResponse{body: `{"data":null}`}
+	fixtures["/api2/json/admin/datastore/store1/snapshots?ns=team-a"] = mockResponse{body: `{}`}
+	server := newMockPBS(t, fixtures)
+	exporter := newTestExporter(t, server.URL, nil)
+
+	// the namespaces are skipped instead of reporting 0 snapshots
+	expected := `
+# HELP pbs_namespace_scrape_errors The number of namespaces of the datastore which failed to be collected during the last query of PBS.
+# TYPE pbs_namespace_scrape_errors gauge
+pbs_namespace_scrape_errors{datastore="store1"} 2
+`
+	err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "pbs_snapshot_count", "pbs_namespace_scrape_errors")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// BenchmarkDecodeSnapshots decodes a large snapshot list. The allocations per op grow with the number
+// of snapshots, as each one is decoded on its own, but the list is never held in memory (compare B/op to the size).
+func BenchmarkDecodeSnapshots(b *testing.B) {
+	fixture := snapshotListFixture(100000)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(fixture)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		count := 0
+		err := decodeSnapshots(strings.NewReader(fixture), func(Snapshot) {
+			count++
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package collector_test
+
+import (
+	"log"
+
+	"github.com/natrontech/pbs-exporter/collector"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func ExampleNew() {
+	config := collector.DefaultConfig()
+	config.Endpoint = "https://pbs.example.com:8007"
+	config.Username = "root@pam"
+	config.APIToken = "..."
+	config.APITokenName = "pbs-exporter"
+	exporter, err := collector.New(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	prometheus.MustRegister(exporter)
+}
@@ -0,0 +1,492 @@
+// Package collector collects the metrics of a Proxmox Backup Server from its api. The Exporter
+// implements prometheus.Collector, so it can be embedded in other programs, see the example of New.
+package collector
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Config is the configuration of an Exporter. Use DefaultConfig to get the defaults of the pbs-exporter.
+type Config struct {
+	// Endpoint is the url of the Proxmox Backup Server, e.g. https://pbs.example.com:8007
+	Endpoint     string
+	Username     string
+	APIToken     string
+	APITokenName string
+
+	// SecondaryAPIToken is tried if PBS rejects the api token (status code 401), e.g. while the token
+	// is rotated. SecondaryAPITokenName is the name of the secondary token, APITokenName if empty.
+	SecondaryAPIToken     string
+	SecondaryAPITokenName string
+
+	// AuthHeaderFormat is the format of the Authorization header, equals (PBSAPIToken=...) or space (PBSAPIToken ...)
+	AuthHeaderFormat string
+
+	// Client sends the requests to the api, http.DefaultClient if nil
+	Client    *http.Client
+	UserAgent string
+
+	// Insecure reports that the client does not verify the TLS certificate of PBS, exposed as pbs_tls_insecure
+	Insecure bool
+
+	// APIBasePath is the base path of the api, e.g. if it is served under a different path by a reverse proxy
+	APIBasePath string
+
+	// Namespace is the prefix of all metric names, ConstLabels are added to all metrics
+	Namespace   string
+	ConstLabels prometheus.Labels
+
+	// Enabled collectors
+	CollectDatastore bool
+	CollectNode      bool
+	CollectSnapshots bool
+	CollectTape      bool
+	CollectOwner     bool
+
+	// CollectDisks enables the SMART health of the disks of the nodes, which is slow to read on hosts
+	// with many disks. A failure only drops the disk metrics.
+	CollectDisks bool
+
+	// Datastore limits the collection to a single datastore, without listing all datastores
+	Datastore string
+
+	// DatastoreNamespace limits the collection to a single namespace of Datastore, without listing all namespaces
+	DatastoreNamespace string
+
+	// UsageHistory enables the metrics derived from the usage history of the datastores
+	UsageHistory bool
+
+	// StaleThreshold is the age of the newest snapshot after which a datastore is reported as stale
+	StaleThreshold time.Duration
+
+	// MaxVMSeries is the maximum number of backup groups per namespace with metrics per vm, 0 is unlimited
+	MaxVMSeries int
+
+	// BackupIDNames maps backup ids to the display names of the name label of the metrics per vm
+	BackupIDNames map[string]string
+
+	// SnapshotSizeBuckets are the upper bounds in bytes of the buckets of the snapshot size histogram
+	SnapshotSizeBuckets []float64
+
+	// Timeout limits each api request including reading the response, 0 means no limit.
+	// The timeout of Client applies in addition.
+	Timeout time.Duration
+
+	// SnapshotTimeout replaces Timeout for the snapshot listing, which can take much longer than the other apis
+	SnapshotTimeout time.Duration
+
+	// ScrapeTimeout limits the duration of a whole collection, 0 means no limit
+	ScrapeTimeout time.Duration
+
+	// LastSuccess is the time of the last successful collection of a previous exporter of the endpoint
+	LastSuccess time.Time
+
+	// ActiveToken is the index of the api token in use by a previous exporter of the endpoint, so the
+	// rejected token is not tried again by every exporter (0 = api token, 1 = secondary api token)
+	ActiveToken int
+
+	// Stats counts scrape timeouts and api requests across exporters, they are not exposed if nil
+	Stats *Stats
+
+	// Debug logs the requests and the status of the responses
+	Debug bool
+
+	// LogBodies additionally logs the response bodies with secrets redacted if Debug is set,
+	// truncated to LogBodiesMaxLength bytes if it is positive
+	LogBodies          bool
+	LogBodiesMaxLength int
+}
+
+// DefaultConfig returns the default configuration, only the endpoint and the credentials need to be set.
+func DefaultConfig() Config {
+	return Config{
+		AuthHeaderFormat:    "equals",
+		UserAgent:           "pbs-exporter",
+		APIBasePath:         DefaultAPIBasePath,
+		Namespace:           "pbs",
+		CollectDatastore:    true,
+		CollectNode:         true,
+		CollectSnapshots:    true,
+		StaleThreshold:      48 * time.Hour,
+		SnapshotSizeBuckets: []float64{1e6, 1e7, 1e8, 1e9, 1e10, 1e11, 1e12},
+		Timeout:             5 * time.Second,
+	}
+}
+
+// labelNameRegexp matches valid prometheus label names
+var labelNameRegexp = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// ValidName returns true if name is a valid prometheus label name, which is also valid as metric namespace.
+func ValidName(name string) bool {
+	return labelNameRegexp.MatchString(name)
+}
+
+// Exporter collects the metrics of a Proxmox Backup Server on every call of Collect.
+type Exporter struct {
+	config  Config
+	metrics *metrics
+
+	// proxyAuthorization is the basic auth header of the userinfo of the endpoint for a reverse proxy
+	// in front of PBS. The Authorization header is taken by the api token, so it is sent as Proxy-Authorization,
+	// which the reverse proxy has to check.
+	proxyAuthorization string
+
+	// authorizationHeaders holds the Authorization header of the api token and of the secondary api token,
+	// activeToken is the index of the header in use. Both can be changed while scrapes are in flight.
+	authMu               sync.RWMutex
+	authorizationHeaders []string
+	activeToken          int
+
+	// permissionDenied holds the requested apis of the current scrape, true if the request was denied
+	mu               sync.Mutex
+	permissionDenied map[string]bool
+
+	// sent is true if any request of the current scrape was sent to PBS instead of being served from a cache,
+	// reachable is true if PBS responded to any of them, guarded by mu
+	sent      bool
+	reachable bool
+
+	// certFingerprint is the sha256 fingerprint of the TLS certificate of PBS seen in the current scrape, guarded by mu
+	certFingerprint string
+
+	// lastSuccess is the time the last collection without error completed, guarded by mu
+	lastSuccess time.Time
+}
+
+// New returns an exporter of the endpoint of config. It returns an error if the config is invalid.
+func New(config Config) (*Exporter, error) {
+	endpoint, err := ParseEndpoint(config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	var proxyAuthorization string
+	config.Endpoint, proxyAuthorization = splitUserinfo(endpoint)
+	if config.APIToken != "" && config.APITokenName == "" {
+		// PBS rejects the resulting PBSAPIToken=user!:token header with a misleading error
+		return nil, errors.New("api token name must not be empty")
+	}
+	if config.AuthHeaderFormat != "equals" && config.AuthHeaderFormat != "space" {
+		return nil, fmt.Errorf("invalid auth header format %q: must be equals or space", config.AuthHeaderFormat)
+	}
+	if !strings.HasPrefix(config.APIBasePath, "/") {
+		return nil, fmt.Errorf("invalid api base path %q: must start with /", config.APIBasePath)
+	}
+	config.APIBasePath = strings.TrimRight(config.APIBasePath, "/")
+	if config.DatastoreNamespace != "" && config.Datastore == "" {
+		return nil, fmt.Errorf("namespace %q requires a datastore", config.DatastoreNamespace)
+	}
+	if !ValidName(config.Namespace) {
+		return nil, fmt.Errorf("invalid metric namespace %q", config.Namespace)
+	}
+	for i := 1; i < len(config.SnapshotSizeBuckets); i++ {
+		if config.SnapshotSizeBuckets[i] <= config.SnapshotSizeBuckets[i-1] {
+			return nil, fmt.Errorf("bucket %g is not larger than the previous bucket", config.SnapshotSizeBuckets[i])
+		}
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	if config.Stats == nil {
+		config.Stats = NewStats(config.Namespace, config.ConstLabels)
+	}
+
+	e := &Exporter{
+		config:             config,
+		proxyAuthorization: proxyAuthorization,
+		metrics:            newMetrics(config.Namespace, config.ConstLabels),
+		permissionDenied:   make(map[string]bool),
+		lastSuccess:        config.LastSuccess,
+	}
+	e.SetCredentials(config.Username, config.APIToken, config.APITokenName)
+	if config.ActiveToken > 0 && config.ActiveToken < len(e.authorizationHeaders) {
+		e.activeToken = config.ActiveToken
+	}
+	return e, nil
+}
+
+// ParseEndpoint validates that endpoint is an absolute http(s) url and returns it without trailing slash,
+// so it can be concatenated with the api paths.
+func ParseEndpoint(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid endpoint %q: %w", endpoint, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("invalid endpoint %q: scheme must be http or https", u.Redacted())
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("invalid endpoint %q: missing host", u.Redacted())
+	}
+	// a path is kept as prefix of the api paths, e.g. for a reverse proxy, but a query would be lost
+	if u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("invalid endpoint %q: must not contain a query or fragment", u.Redacted())
+	}
+	return strings.TrimRight(u.String(), "/"), nil
+}
+
+// splitUserinfo removes the userinfo from endpoint and returns it as basic auth header,
+// the header is empty if the endpoint has no userinfo.
+func splitUserinfo(endpoint string) (string, string) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.User == nil {
+		return endpoint, ""
+	}
+	password, _ := u.User.Password()
+	header := "Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+password))
+	u.User = nil
+	return u.String(), header
+}
+
+// SetCredentials sets the Authorization header used for all requests of the exporter,
+// e.g. to rotate the api token while the exporter is running. The secondary api token is kept.
+func (e *Exporter) SetCredentials(username string, apitoken string, apitokenname string) {
+	e.authMu.Lock()
+	defer e.authMu.Unlock()
+	e.authorizationHeaders = []string{authorizationHeader(e.config.AuthHeaderFormat, username, apitoken, apitokenname)}
+	if e.config.SecondaryAPIToken != "" {
+		secondaryName := e.config.SecondaryAPITokenName
+		if secondaryName == "" {
+			secondaryName = apitokenname
+		}
+		e.authorizationHeaders = append(e.authorizationHeaders,
+			authorizationHeader(e.config.AuthHeaderFormat, username, e.config.SecondaryAPIToken, secondaryName))
+	}
+	e.activeToken = 0
+}
+
+// LastSuccess returns the time the last collection without error completed, zero if there was none.
+func (e *Exporter) LastSuccess() time.Time {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.lastSuccess
+}
+
+// ActiveToken returns the index of the api token in use (0 = api token, 1 = secondary api token).
+func (e *Exporter) ActiveToken() int {
+	_, token := e.authorization()
+	return token
+}
+
+// authorizationHeader returns the Authorization header of an api token in the given format,
+// some reverse proxies only pass on one of the formats supported by PBS.
+func authorizationHeader(format string, username string, apitoken string, apitokenname string) string {
+	separator := "="
+	if format == "space" {
+		separator = " "
+	}
+	return "PBSAPIToken" + separator + username + "!" + apitokenname + ":" + apitoken
+}
+
+// authorization returns the Authorization header of the api token in use and its index.
+func (e *Exporter) authorization() (string, int) {
+	e.authMu.RLock()
+	defer e.authMu.RUnlock()
+	return e.authorizationHeaders[e.activeToken], e.activeToken
+}
+
+// fallbackAuthorization returns the Authorization header of the api token to try after the token
+// with the given index was rejected. It returns false if there is no other token.
+func (e *Exporter) fallbackAuthorization(token int) (string, int, bool) {
+	e.authMu.RLock()
+	defer e.authMu.RUnlock()
+	if len(e.authorizationHeaders) < 2 {
+		return "", 0, false
+	}
+	fallback := (token + 1) % len(e.authorizationHeaders)
+	return e.authorizationHeaders[fallback], fallback, true
+}
+
+// setActiveToken uses the api token with the given index for the following requests.
+func (e *Exporter) setActiveToken(token int) {
+	e.authMu.Lock()
+	defer e.authMu.Unlock()
+	if e.activeToken != token {
+		log.Printf("INFO: Api token %d was rejected by endpoint %s, using api token %d", e.activeToken, e.config.Endpoint, token)
+		e.activeToken = token
+	}
+}
+
+func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- e.metrics.up
+	ch <- e.metrics.reachable
+	ch <- e.metrics.last_success_timestamp
+	ch <- e.metrics.tls_insecure
+	ch <- e.metrics.cert_fingerprint_info
+	ch <- e.metrics.active_token_index
+	ch <- e.metrics.version
+	ch <- e.metrics.datastore_count
+	ch <- e.metrics.datastore_info
+	ch <- e.metrics.datastore_notify_configured
+	ch <- e.metrics.available
+	ch <- e.metrics.size
+	ch <- e.metrics.used
+	ch <- e.metrics.datastore_used_fraction
+	ch <- e.metrics.datastore_estimated_full_timestamp
+	ch <- e.metrics.datastore_available
+	ch <- e.metrics.removable_datastore_mounted
+	ch <- e.metrics.datastore_read_bytes
+	ch <- e.metrics.datastore_write_bytes
+	ch <- e.metrics.datastore_stale
+	ch <- e.metrics.gc_last_run_timestamp
+	ch <- e.metrics.gc_seconds_since_last_run
+	ch <- e.metrics.gc_running
+	ch <- e.metrics.gc_overdue
+	ch <- e.metrics.gc_schedule_info
+	ch <- e.metrics.datastore_chunk_count
+	ch <- e.metrics.gc_bad_chunks
+	ch <- e.metrics.datastore_chunk_bytes
+	ch <- e.metrics.datastore_index_data_bytes
+	ch <- e.metrics.namespace_count
+	ch <- e.metrics.namespace_scrape_errors
+	ch <- e.metrics.snapshot_count
+	ch <- e.metrics.total_snapshot_count
+	ch <- e.metrics.snapshot_count_by_type
+	ch <- e.metrics.snapshot_count_by_owner
+	ch <- e.metrics.snapshot_size_bytes
+	ch <- e.metrics.unverified_snapshot_count
+	ch <- e.metrics.snapshot_verification_count
+	ch <- e.metrics.namespace_oldest_snapshot_timestamp
+	ch <- e.metrics.namespace_newest_snapshot_timestamp
+	ch <- e.metrics.snapshot_vm_count
+	ch <- e.metrics.snapshot_vm_last_timestamp
+	ch <- e.metrics.snapshot_vm_last_verify
+	ch <- e.metrics.snapshot_vm_count_truncated
+	ch <- e.metrics.host_cpu_usage
+	ch <- e.metrics.host_memory_free
+	ch <- e.metrics.host_memory_total
+	ch <- e.metrics.host_memory_used
+	ch <- e.metrics.host_swap_free
+	ch <- e.metrics.host_swap_total
+	ch <- e.metrics.host_swap_used
+	ch <- e.metrics.host_disk_available
+	ch <- e.metrics.host_disk_total
+	ch <- e.metrics.host_disk_used
+	ch <- e.metrics.host_uptime
+	ch <- e.metrics.host_io_wait
+	ch <- e.metrics.host_load1
+	ch <- e.metrics.host_load5
+	ch <- e.metrics.host_load15
+	ch <- e.metrics.host_net_in_bytes
+	ch <- e.metrics.host_net_out_bytes
+	ch <- e.metrics.disk_health
+	ch <- e.metrics.disk_wearout
+	ch <- e.metrics.last_failed_task
+	ch <- e.metrics.oldest_running_task_age_seconds
+	ch <- e.metrics.configured_jobs
+	ch <- e.metrics.enabled_jobs
+	ch <- e.metrics.tape_drive_status
+	ch <- e.metrics.tape_backup_job_status
+	ch <- e.metrics.tape_backup_last_run_timestamp
+	ch <- e.metrics.api_permission_denied
+}
+
+func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	ctx := context.Background()
+	if e.config.ScrapeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.config.ScrapeTimeout)
+		defer cancel()
+	}
+
+	e.mu.Lock()
+	e.permissionDenied = make(map[string]bool)
+	e.sent = false
+	e.reachable = false
+	e.certFingerprint = ""
+	e.mu.Unlock()
+
+	err := e.collectFromAPI(ctx, ch)
+
+	// set permission metrics, also if the collection failed
+	e.mu.Lock()
+	for api, denied := range e.permissionDenied {
+		deniedValue := 0
+		if denied {
+			deniedValue = 1
+		}
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.api_permission_denied, prometheus.GaugeValue, float64(deniedValue), api,
+		)
+	}
+	if err == nil {
+		e.lastSuccess = time.Now()
+	}
+	lastSuccess := e.lastSuccess
+	sent := e.sent
+	reachable := e.reachable
+	certFingerprint := e.certFingerprint
+	e.mu.Unlock()
+
+	// set reachable metric, only connection failures (e.g. dns, tls) make PBS unreachable.
+	// It is not set if all responses were served from the cache, as PBS was not asked.
+	if sent {
+		reachableValue := 0
+		if reachable {
+			reachableValue = 1
+		}
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.reachable, prometheus.GaugeValue, float64(reachableValue),
+		)
+	}
+
+	// set last success timestamp, 0 if there was no successful collection yet
+	lastSuccessValue := 0.0
+	if !lastSuccess.IsZero() {
+		lastSuccessValue = float64(lastSuccess.Unix())
+	}
+	ch <- prometheus.MustNewConstMetric(
+		e.metrics.last_success_timestamp, prometheus.GaugeValue, lastSuccessValue,
+	)
+
+	// set active token metric, 0 is the api token and 1 the secondary api token
+	_, activeToken := e.authorization()
+	ch <- prometheus.MustNewConstMetric(
+		e.metrics.active_token_index, prometheus.GaugeValue, float64(activeToken),
+	)
+
+	// set tls insecure metric, so a disabled certificate verification can be alerted on
+	insecureValue := 0
+	if e.config.Insecure {
+		insecureValue = 1
+	}
+	ch <- prometheus.MustNewConstMetric(
+		e.metrics.tls_insecure, prometheus.GaugeValue, float64(insecureValue),
+	)
+
+	// set certificate fingerprint, a new series shows a replaced certificate
+	if certFingerprint != "" {
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.cert_fingerprint_info, prometheus.GaugeValue, 1, certFingerprint,
+		)
+	}
+
+	if err != nil {
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.up, prometheus.GaugeValue, 0,
+		)
+		// a timeout of a single request is not a scrape timeout
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			e.config.Stats.scrapeTimeouts.Inc()
+			log.Printf("ERROR: Scrape timeout of %s exceeded: %s", e.config.ScrapeTimeout, err)
+			return
+		}
+		log.Printf("ERROR: %s", err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(
+		e.metrics.up, prometheus.GaugeValue, 1,
+	)
+
+}
@@ -0,0 +1,308 @@
+package collector
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseEndpoint(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		endpoint string
+		expected string
+		valid    bool
+	}{
+		{name: "https", endpoint: "https://pbs.example.com:8007", expected: "https://pbs.example.com:8007", valid: true},
+		{name: "http", endpoint: "http://pbs.example.com:8007", expected: "http://pbs.example.com:8007", valid: true},
+		{name: "trailing slash", endpoint: "https://pbs.example.com:8007/", expected: "https://pbs.example.com:8007", valid: true},
+		{name: "path", endpoint: "https://proxy.example.com/pbs/", expected: "https://proxy.example.com/pbs", valid: true},
+		{name: "ipv6", endpoint: "https://[::1]:8007", expected: "https://[::1]:8007", valid: true},
+		{name: "missing scheme", endpoint: "pbs.example.com:8007"},
+		{name: "missing scheme without port", endpoint: "pbs.example.com"},
+		{name: "other scheme", endpoint: "ftp://pbs.example.com"},
+		{name: "missing host", endpoint: "https://"},
+		{name: "missing host with path", endpoint: "https:///api2/json"},
+		{name: "query", endpoint: "https://pbs.example.com:8007?debug=1"},
+		{name: "fragment", endpoint: "https://pbs.example.com:8007#top"},
+		{name: "empty", endpoint: ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			endpoint, err := ParseEndpoint(test.endpoint)
+			if !test.valid {
+				if err == nil {
+					t.Errorf("expected an error for %q, got %q", test.endpoint, endpoint)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if endpoint != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, endpoint)
+			}
+		})
+	}
+}
+
+func TestRegisterTwoExporters(t *testing.T) {
+	server := newMockPBS(t, mockFixtures())
+	for name, configs := range map[string][2]func(*Config){
+		"namespace": {
+			func(config *Config) { config.Namespace = "pbs" },
+			func(config *Config) { config.Namespace = "backup" },
+		},
+		"const labels": {
+			func(config *Config) { config.ConstLabels = prometheus.Labels{"site": "dc1"} },
+			func(config *Config) { config.ConstLabels = prometheus.Labels{"site": "dc2"} },
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			registry := prometheus.NewRegistry()
+			for _, modify := range configs {
+				exporter := newTestExporter(t, server.URL, modify)
+				if err := registry.Register(exporter); err != nil {
+					t.Fatal(err)
+				}
+				if err := registry.Register(exporter.config.Stats); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			families, err := registry.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			up := 0
+			for _, family := range families {
+				if family.GetName() == "pbs_up" || family.GetName() == "backup_up" {
+					up += len(family.GetMetric())
+				}
+			}
+			if up != 2 {
+				t.Errorf("expected an up metric of each exporter, got %d", up)
+			}
+		})
+	}
+}
+
+func TestAuthHeaderFormat(t *testing.T) {
+	for format, expected := range map[string]string{
+		"equals": "PBSAPIToken=root@pam!pbs-exporter:secret",
+		"space":  "PBSAPIToken root@pam!pbs-exporter:secret",
+	} {
+		t.Run(format, func(t *testing.T) {
+			var authorization []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				authorization = append(authorization, r.Header.Get("Authorization"))
+				_, _ = w.Write([]byte(`{"data":{"version":"3.2.2"}}`))
+			}))
+			defer server.Close()
+			exporter := newTestExporter(t, server.URL, func(config *Config) {
+				config.AuthHeaderFormat = format
+				config.CollectDatastore = false
+				config.CollectNode = false
+			})
+
+			testutil.CollectAndCount(exporter, "pbs_up")
+			if len(authorization) == 0 {
+				t.Fatal("no request was sent")
+			}
+			for _, header := range authorization {
+				if header != expected {
+					t.Errorf("expected Authorization header %q, got %q", expected, header)
+				}
+			}
+		})
+	}
+}
+
+// newBasicAuthProxy returns a https reverse proxy in front of the mock PBS, which checks the basic auth
+// of the Proxy-Authorization header. The header is hop-by-hop, so it is not forwarded to PBS.
+func newBasicAuthProxy(t *testing.T, pbs *httptest.Server) *httptest.Server {
+	t.Helper()
+	target, err := url.Parse(pbs.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forward := httputil.NewSingleHostReverseProxy(target)
+	expected := "Basic " + base64.StdEncoding.EncodeToString([]byte("proxy-user:proxy-pass"))
+	proxy := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != expected {
+			http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+			return
+		}
+		forward.ServeHTTP(w, r)
+	}))
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+func TestEndpointUserinfo(t *testing.T) {
+	fixtures := mockFixtures()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" {
+			t.Error("the Proxy-Authorization header was forwarded to PBS")
+		}
+		mockPBSHandler(fixtures).ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	proxy := newBasicAuthProxy(t, server)
+
+	for _, test := range []struct {
+		user     *url.Userinfo
+		expected string
+	}{
+		{user: url.UserPassword("proxy-user", "proxy-pass"), expected: "1"},
+		{user: url.UserPassword("proxy-user", "wrong"), expected: "0"},
+		{expected: "0"},
+	} {
+		endpoint, err := url.Parse(proxy.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		endpoint.User = test.user
+		exporter := newTestExporter(t, endpoint.String(), func(config *Config) {
+			config.Client = proxy.Client()
+		})
+		if strings.Contains(exporter.config.Endpoint, "proxy-pass") {
+			t.Errorf("the userinfo was not removed from the endpoint %s", exporter.config.Endpoint)
+		}
+
+		// PBS only answers if the api token passed the proxy
+		expected := `
+# HELP pbs_up Was the last query of PBS successful.
+# TYPE pbs_up gauge
+pbs_up ` + test.expected + `
+`
+		if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "pbs_up"); err != nil {
+			t.Errorf("%s: %s", endpoint.Redacted(), err)
+		}
+	}
+}
+
+func TestNewAPITokenName(t *testing.T) {
+	config := DefaultConfig()
+	config.Endpoint = "https://pbs.example.com:8007"
+	config.Username = "root@pam"
+	config.APIToken = "secret"
+	if _, err := New(config); err == nil {
+		t.Error("expected an error for an api token without name")
+	}
+
+	// without api token there is no token name required
+	config.APIToken = ""
+	if _, err := New(config); err != nil {
+		t.Errorf("unexpected error without api token: %s", err)
+	}
+}
+
+func TestAuthorizationHeader(t *testing.T) {
+	headerRegexp := regexp.MustCompile(`^PBSAPIToken[= ][^!:\s]+![^!:\s]+:\S+$`)
+	for _, test := range []struct {
+		format   string
+		expected string
+	}{
+		{format: "equals", expected: "PBSAPIToken=root@pam!pbs-exporter:aaaaaaaa-bbbb-cccc-dddd-eeeeeeeeeeee"},
+		{format: "space", expected: "PBSAPIToken root@pam!pbs-exporter:aaaaaaaa-bbbb-cccc-dddd-eeeeeeeeeeee"},
+	} {
+		t.Run(test.format, func(t *testing.T) {
+			header := authorizationHeader(test.format, "root@pam", "aaaaaaaa-bbbb-cccc-dddd-eeeeeeeeeeee", "pbs-exporter")
+			if header != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, header)
+			}
+			if !headerRegexp.MatchString(header) {
+				t.Errorf("malformed header %q", header)
+			}
+		})
+	}
+}
+
+func TestSecondaryAPIToken(t *testing.T) {
+	var rejected atomic.Int32
+	handler := mockPBSHandler(mockFixtures())
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != testAuthorization {
+			rejected.Add(1)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	// the mock PBS only accepts the secondary api token
+	exporter := newTestExporter(t, server.URL, func(config *Config) {
+		config.APIToken = "revoked"
+		config.SecondaryAPIToken = "secret"
+	})
+	expected := `
+# HELP pbs_up Was the last query of PBS successful.
+# TYPE pbs_up gauge
+pbs_up 1
+# HELP pbs_active_token_index The index of the api token in use (0 = api token, 1 = secondary api token).
+# TYPE pbs_active_token_index gauge
+pbs_active_token_index 1
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "pbs_up", "pbs_active_token_index"); err != nil {
+		t.Error(err)
+	}
+	if count := rejected.Load(); count != 1 {
+		t.Errorf("expected a single rejected request, got %d", count)
+	}
+
+	// the next exporter of the endpoint starts with the secondary api token
+	rejected.Store(0)
+	next := newTestExporter(t, server.URL, func(config *Config) {
+		config.APIToken = "revoked"
+		config.SecondaryAPIToken = "secret"
+		config.ActiveToken = exporter.ActiveToken()
+	})
+	if err := testutil.CollectAndCompare(next, strings.NewReader(expected), "pbs_up", "pbs_active_token_index"); err != nil {
+		t.Error(err)
+	}
+	if count := rejected.Load(); count != 0 {
+		t.Errorf("expected no rejected request, got %d", count)
+	}
+}
+
+func TestSecondaryAPITokenUnreachable(t *testing.T) {
+	// the connection is closed after the first request was rejected
+	server := httptest.NewServer(nil)
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == testAuthorization {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			conn.Close()
+			return
+		}
+		http.Error(w, `{"data":null}`, http.StatusUnauthorized)
+	})
+	defer server.Close()
+	exporter := newTestExporter(t, server.URL, func(config *Config) {
+		config.APIToken = "revoked"
+		config.SecondaryAPIToken = "secret"
+	})
+
+	err := exporter.apiGet(context.Background(), versionApi, nil, nil, &VersionResponse{})
+	if err == nil || !strings.Contains(err.Error(), "after api token 0 was rejected") {
+		t.Errorf("expected the error of the secondary api token, got %v", err)
+	}
+	exporter.mu.Lock()
+	sent := exporter.sent
+	exporter.mu.Unlock()
+	if !sent {
+		t.Error("expected the request to be counted as sent")
+	}
+}
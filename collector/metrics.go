@@ -0,0 +1,489 @@
+package collector
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// metrics holds the metric descriptors of an exporter.
+type metrics struct {
+	up                                  *prometheus.Desc
+	reachable                           *prometheus.Desc
+	last_success_timestamp              *prometheus.Desc
+	tls_insecure                        *prometheus.Desc
+	cert_fingerprint_info               *prometheus.Desc
+	active_token_index                  *prometheus.Desc
+	version                             *prometheus.Desc
+	datastore_count                     *prometheus.Desc
+	datastore_info                      *prometheus.Desc
+	datastore_notify_configured         *prometheus.Desc
+	available                           *prometheus.Desc
+	size                                *prometheus.Desc
+	used                                *prometheus.Desc
+	datastore_used_fraction             *prometheus.Desc
+	datastore_estimated_full_timestamp  *prometheus.Desc
+	datastore_available                 *prometheus.Desc
+	removable_datastore_mounted         *prometheus.Desc
+	datastore_read_bytes                *prometheus.Desc
+	datastore_write_bytes               *prometheus.Desc
+	datastore_stale                     *prometheus.Desc
+	gc_last_run_timestamp               *prometheus.Desc
+	gc_seconds_since_last_run           *prometheus.Desc
+	gc_running                          *prometheus.Desc
+	gc_overdue                          *prometheus.Desc
+	gc_schedule_info                    *prometheus.Desc
+	datastore_chunk_count               *prometheus.Desc
+	gc_bad_chunks                       *prometheus.Desc
+	datastore_chunk_bytes               *prometheus.Desc
+	datastore_index_data_bytes          *prometheus.Desc
+	namespace_count                     *prometheus.Desc
+	namespace_scrape_errors             *prometheus.Desc
+	snapshot_count                      *prometheus.Desc
+	total_snapshot_count                *prometheus.Desc
+	snapshot_count_by_type              *prometheus.Desc
+	snapshot_count_by_owner             *prometheus.Desc
+	snapshot_size_bytes                 *prometheus.Desc
+	unverified_snapshot_count           *prometheus.Desc
+	snapshot_verification_count         *prometheus.Desc
+	namespace_oldest_snapshot_timestamp *prometheus.Desc
+	namespace_newest_snapshot_timestamp *prometheus.Desc
+	snapshot_vm_count                   *prometheus.Desc
+	snapshot_vm_last_timestamp          *prometheus.Desc
+	snapshot_vm_last_verify             *prometheus.Desc
+	snapshot_vm_count_truncated         *prometheus.Desc
+	host_cpu_usage                      *prometheus.Desc
+	host_memory_free                    *prometheus.Desc
+	host_memory_total                   *prometheus.Desc
+	host_memory_used                    *prometheus.Desc
+	host_swap_free                      *prometheus.Desc
+	host_swap_total                     *prometheus.Desc
+	host_swap_used                      *prometheus.Desc
+	host_disk_available                 *prometheus.Desc
+	host_disk_total                     *prometheus.Desc
+	host_disk_used                      *prometheus.Desc
+	host_uptime                         *prometheus.Desc
+	host_io_wait                        *prometheus.Desc
+	host_load1                          *prometheus.Desc
+	host_load5                          *prometheus.Desc
+	host_load15                         *prometheus.Desc
+	host_net_in_bytes                   *prometheus.Desc
+	host_net_out_bytes                  *prometheus.Desc
+	disk_health                         *prometheus.Desc
+	disk_wearout                        *prometheus.Desc
+	last_failed_task                    *prometheus.Desc
+	oldest_running_task_age_seconds     *prometheus.Desc
+	configured_jobs                     *prometheus.Desc
+	enabled_jobs                        *prometheus.Desc
+	api_permission_denied               *prometheus.Desc
+
+	// tape metrics, only collected with pbs.collect-tape
+	tape_drive_status              *prometheus.Desc
+	tape_backup_job_status         *prometheus.Desc
+	tape_backup_last_run_timestamp *prometheus.Desc
+}
+
+// newMetrics builds the metric descriptors, the names are prefixed with namespace
+// and constLabels are added to all metrics.
+func newMetrics(namespace string, constLabels prometheus.Labels) *metrics {
+	m := &metrics{}
+
+	m.up = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "up"),
+		"Was the last query of PBS successful.",
+		nil, constLabels,
+	)
+	m.reachable = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "reachable"),
+		"Did PBS respond to any request of the last query, also with an error status.",
+		nil, constLabels,
+	)
+	m.last_success_timestamp = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "exporter", "last_success_timestamp"),
+		"Unix timestamp of the last successful query of PBS.",
+		nil, constLabels,
+	)
+	m.tls_insecure = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "tls_insecure"),
+		"Is the TLS certificate verification of PBS disabled.",
+		nil, constLabels,
+	)
+	m.cert_fingerprint_info = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "cert_fingerprint_info"),
+		"The sha256 fingerprint of the TLS certificate of PBS (always 1).",
+		[]string{"sha256"}, constLabels,
+	)
+	m.active_token_index = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "active_token_index"),
+		"The index of the api token in use (0 = api token, 1 = secondary api token).",
+		nil, constLabels,
+	)
+	m.version = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "version"),
+		"Version of the PBS installation.",
+		[]string{"version", "repoid", "release"}, constLabels,
+	)
+	m.datastore_count = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "datastore_count"),
+		"The number of datastores.",
+		nil, constLabels,
+	)
+	m.datastore_info = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "datastore_info"),
+		"Information about the datastore configuration (always 1).",
+		[]string{"datastore", "path", "type", "comment"}, constLabels,
+	)
+	m.datastore_notify_configured = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "datastore_notify_configured"),
+		"Are notifications of job results configured for the datastore.",
+		[]string{"datastore"}, constLabels,
+	)
+	m.available = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "available"),
+		"The available bytes of the underlying storage.",
+		[]string{"datastore"}, constLabels,
+	)
+	m.size = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "size"),
+		"The size of the underlying storage in bytes.",
+		[]string{"datastore"}, constLabels,
+	)
+	m.used = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "used"),
+		"The used bytes of the underlying storage.",
+		[]string{"datastore"}, constLabels,
+	)
+	m.datastore_used_fraction = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "datastore_used_fraction"),
+		"The used fraction (0-1) of the underlying storage.",
+		[]string{"datastore"}, constLabels,
+	)
+	m.datastore_estimated_full_timestamp = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "datastore_estimated_full_timestamp"),
+		"The timestamp when the datastore is estimated to be full, derived from the usage history by PBS.",
+		[]string{"datastore"}, constLabels,
+	)
+	m.datastore_available = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "datastore_available"),
+		"Is the datastore available (mounted and its status readable).",
+		[]string{"datastore"}, constLabels,
+	)
+	m.removable_datastore_mounted = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "removable_datastore_mounted"),
+		"Is the device of the removable datastore mounted.",
+		[]string{"datastore"}, constLabels,
+	)
+	m.datastore_read_bytes = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "datastore_read_bytes"),
+		"The read rate of the datastore in bytes per second (latest rrd sample).",
+		[]string{"datastore"}, constLabels,
+	)
+	m.datastore_write_bytes = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "datastore_write_bytes"),
+		"The write rate of the datastore in bytes per second (latest rrd sample).",
+		[]string{"datastore"}, constLabels,
+	)
+	m.datastore_stale = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "datastore_stale"),
+		"Is the newest snapshot of the datastore older than the stale threshold (or there is none).",
+		[]string{"datastore"}, constLabels,
+	)
+	m.gc_last_run_timestamp = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "gc_last_run_timestamp"),
+		"Unix timestamp of the end of the last garbage collection of the datastore.",
+		[]string{"datastore"}, constLabels,
+	)
+	m.gc_seconds_since_last_run = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "gc_seconds_since_last_run"),
+		"Seconds since the end of the last garbage collection of the datastore.",
+		[]string{"datastore"}, constLabels,
+	)
+	m.gc_running = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "gc_running"),
+		"Is a garbage collection of the datastore running.",
+		[]string{"datastore"}, constLabels,
+	)
+	m.gc_overdue = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "gc_overdue"),
+		"Is the scheduled garbage collection of the datastore overdue.",
+		[]string{"datastore"}, constLabels,
+	)
+	m.gc_schedule_info = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "gc_schedule_info"),
+		"The configured garbage collection schedule of the datastore, none if there is no schedule (always 1).",
+		[]string{"datastore", "schedule"}, constLabels,
+	)
+	m.datastore_chunk_count = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "datastore_chunk_count"),
+		"The number of chunks of the datastore, counted by the last garbage collection.",
+		[]string{"datastore"}, constLabels,
+	)
+	m.gc_bad_chunks = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "gc_bad_chunks"),
+		"The number of bad chunks still present in the datastore, counted by the last garbage collection.",
+		[]string{"datastore"}, constLabels,
+	)
+	m.datastore_chunk_bytes = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "datastore_chunk_bytes"),
+		"The bytes of all chunks of the datastore on disk, counted by the last garbage collection.",
+		[]string{"datastore"}, constLabels,
+	)
+	m.datastore_index_data_bytes = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "datastore_index_data_bytes"),
+		"The bytes referenced by all indexes of the datastore before deduplication, counted by the last garbage collection.",
+		[]string{"datastore"}, constLabels,
+	)
+	m.namespace_count = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "namespace_count"),
+		"The number of namespaces of a datastore, including the root namespace.",
+		[]string{"datastore"}, constLabels,
+	)
+	m.namespace_scrape_errors = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "namespace_scrape_errors"),
+		"The number of namespaces of the datastore which failed to be collected during the last query of PBS.",
+		[]string{"datastore"}, constLabels,
+	)
+	m.snapshot_count = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "snapshot_count"),
+		"The total number of backups.",
+		[]string{"datastore", "namespace"}, constLabels,
+	)
+	m.total_snapshot_count = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "total_snapshot_count"),
+		"The total number of backups of all datastores and namespaces.",
+		nil, constLabels,
+	)
+	m.snapshot_count_by_type = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "snapshot_count_by_type"),
+		"The total number of backups per backup type (vm, ct, host).",
+		[]string{"datastore", "namespace", "backup_type"}, constLabels,
+	)
+	m.snapshot_count_by_owner = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "snapshot_count_by_owner"),
+		"The total number of backups per owner of the backup group.",
+		[]string{"datastore", "namespace", "owner"}, constLabels,
+	)
+	m.snapshot_size_bytes = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "snapshot_size_bytes"),
+		"The distribution of the backup sizes of the datastore.",
+		[]string{"datastore"}, constLabels,
+	)
+	m.unverified_snapshot_count = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "unverified_snapshot_count"),
+		"The number of backups which were never verified.",
+		[]string{"datastore", "namespace"}, constLabels,
+	)
+	m.snapshot_verification_count = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "snapshot_verification_count"),
+		"The number of backups by the state of their last verification (ok, failed or none).",
+		[]string{"datastore", "namespace", "state"}, constLabels,
+	)
+	m.namespace_oldest_snapshot_timestamp = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "namespace_oldest_snapshot_timestamp"),
+		"The timestamp of the oldest backup of the namespace.",
+		[]string{"datastore", "namespace"}, constLabels,
+	)
+	m.namespace_newest_snapshot_timestamp = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "namespace_newest_snapshot_timestamp"),
+		"The timestamp of the newest backup of the namespace.",
+		[]string{"datastore", "namespace"}, constLabels,
+	)
+	m.snapshot_vm_count = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "snapshot_vm_count"),
+		"The total number of backups per VM.",
+		[]string{"datastore", "namespace", "vm_id", "vm_name", "name"}, constLabels,
+	)
+	m.snapshot_vm_last_timestamp = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "snapshot_vm_last_timestamp"),
+		"The timestamp of the last backup of a VM.",
+		[]string{"datastore", "namespace", "vm_id", "vm_name", "name"}, constLabels,
+	)
+	m.snapshot_vm_last_verify = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "snapshot_vm_last_verify"),
+		"The verify status of the last backup of a VM.",
+		[]string{"datastore", "namespace", "vm_id", "vm_name", "name"}, constLabels,
+	)
+	m.snapshot_vm_count_truncated = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "snapshot_vm_count_truncated"),
+		"Were the snapshot metrics per VM skipped, because the namespace has more backup groups than the max vm series.",
+		[]string{"datastore", "namespace"}, constLabels,
+	)
+	m.host_cpu_usage = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "host_cpu_usage"),
+		"The CPU usage of the host.",
+		[]string{"node"}, constLabels,
+	)
+	m.host_memory_free = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "host_memory_free"),
+		"The free memory of the host.",
+		[]string{"node"}, constLabels,
+	)
+	m.host_memory_total = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "host_memory_total"),
+		"The total memory of the host.",
+		[]string{"node"}, constLabels,
+	)
+	m.host_memory_used = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "host_memory_used"),
+		"The used memory of the host.",
+		[]string{"node"}, constLabels,
+	)
+	m.host_swap_free = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "host_swap_free"),
+		"The free swap of the host.",
+		[]string{"node"}, constLabels,
+	)
+	m.host_swap_total = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "host_swap_total"),
+		"The total swap of the host.",
+		[]string{"node"}, constLabels,
+	)
+	m.host_swap_used = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "host_swap_used"),
+		"The used swap of the host.",
+		[]string{"node"}, constLabels,
+	)
+	m.host_disk_available = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "host_disk_available"),
+		"The available disk of the local root disk in bytes.",
+		[]string{"node"}, constLabels,
+	)
+	m.host_disk_total = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "host_disk_total"),
+		"The total disk of the local root disk in bytes.",
+		[]string{"node"}, constLabels,
+	)
+	m.host_disk_used = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "host_disk_used"),
+		"The used disk of the local root disk in bytes.",
+		[]string{"node"}, constLabels,
+	)
+	m.host_uptime = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "host_uptime"),
+		"The uptime of the host.",
+		[]string{"node"}, constLabels,
+	)
+	m.host_io_wait = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "host_io_wait"),
+		"The io wait of the host.",
+		[]string{"node"}, constLabels,
+	)
+	m.host_load1 = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "host_load1"),
+		"The load for 1 minute of the host.",
+		[]string{"node"}, constLabels,
+	)
+	m.host_load5 = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "host_load5"),
+		"The load for 5 minutes of the host.",
+		[]string{"node"}, constLabels,
+	)
+	m.host_load15 = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "host_load15"),
+		"The load for 15 minutes of the host.",
+		[]string{"node"}, constLabels,
+	)
+	m.host_net_in_bytes = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "host_net_in_bytes"),
+		"The inbound network traffic of the host in bytes per second (latest rrd sample).",
+		[]string{"node"}, constLabels,
+	)
+	m.host_net_out_bytes = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "host_net_out_bytes"),
+		"The outbound network traffic of the host in bytes per second (latest rrd sample).",
+		[]string{"node"}, constLabels,
+	)
+	m.disk_health = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "disk_health"),
+		"The SMART health of the disk (1 = passed, 0 = failed, -1 = unknown).",
+		[]string{"node", "device"}, constLabels,
+	)
+	m.disk_wearout = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "disk_wearout"),
+		"The estimated wearout of the disk in percent (0 = new, 100 = used).",
+		[]string{"node", "device"}, constLabels,
+	)
+	m.last_failed_task = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "last_failed_task"),
+		"The end timestamp of the most recent task of each type which did not end with OK.",
+		[]string{"node", "type", "upid", "worker_id"}, constLabels,
+	)
+	m.oldest_running_task_age_seconds = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "oldest_running_task_age_seconds"),
+		"The number of seconds since the start of the oldest running task of each type.",
+		[]string{"node", "type"}, constLabels,
+	)
+	m.tape_drive_status = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "tape_drive_status"),
+		"The current activity of the tape drive (always 1).",
+		[]string{"drive", "activity"}, constLabels,
+	)
+	m.tape_backup_job_status = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "tape_backup_job_status"),
+		"Was the last run of the tape backup job successful.",
+		[]string{"job"}, constLabels,
+	)
+	m.tape_backup_last_run_timestamp = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "tape_backup_last_run_timestamp"),
+		"Unix timestamp of the end of the last run of the tape backup job.",
+		[]string{"job"}, constLabels,
+	)
+	m.configured_jobs = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "configured_jobs"),
+		"The number of configured jobs by type (gc, verify, prune, sync).",
+		[]string{"type"}, constLabels,
+	)
+	m.enabled_jobs = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "enabled_jobs"),
+		"The number of jobs with a schedule which are not disabled by type (gc, verify, prune, sync).",
+		[]string{"type"}, constLabels,
+	)
+	m.api_permission_denied = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "api_permission_denied"),
+		"Was a request to the api denied during the last query of PBS (missing privileges of the token).",
+		[]string{"api"}, constLabels,
+	)
+
+	return m
+}
+
+// Stats are the self metrics of the exporter. The metrics of an exporter are built from the responses
+// of PBS on every scrape, the stats are cumulative across scrapes and can be shared by exporters.
+// Stats implements prometheus.Collector, it has to be registered once.
+type Stats struct {
+	scrapeTimeouts prometheus.Counter
+	apiRequests    *prometheus.CounterVec
+	apiRateLimited prometheus.Counter
+}
+
+// NewStats builds the self metrics, the names are prefixed with namespace and constLabels are added to all metrics.
+func NewStats(namespace string, constLabels prometheus.Labels) *Stats {
+	return &Stats{
+		scrapeTimeouts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "scrape_timeout_total",
+			Help:        "The number of scrapes which exceeded the scrape timeout.",
+			ConstLabels: constLabels,
+		}),
+		apiRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "api_requests_total",
+			Help:        "The number of requests to the api by status code.",
+			ConstLabels: constLabels,
+		}, []string{"api", "code"}),
+		apiRateLimited: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "api_rate_limited_total",
+			Help:        "The number of requests to the api which were rate limited (status code 429).",
+			ConstLabels: constLabels,
+		}),
+	}
+}
+
+func (s *Stats) Describe(ch chan<- *prometheus.Desc) {
+	s.scrapeTimeouts.Describe(ch)
+	s.apiRequests.Describe(ch)
+	s.apiRateLimited.Describe(ch)
+}
+
+func (s *Stats) Collect(ch chan<- prometheus.Metric) {
+	s.scrapeTimeouts.Collect(ch)
+	s.apiRequests.Collect(ch)
+	s.apiRateLimited.Collect(ch)
+}
@@ -0,0 +1,39 @@
+package collector
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestStatsAcrossScrapes(t *testing.T) {
+	fixtures := mockFixtures()
+	fixtures["/api2/json/nodes/localhost/status"] = mockResponse{status: http.StatusTooManyRequests}
+	server := newMockPBS(t, fixtures)
+	stats := NewStats("pbs", nil)
+
+	// a new exporter per scrape shares the stats, like the exporters of the metrics handler
+	var statusRateLimited, rateLimited float64
+	for i := 0; i < 3; i++ {
+		exporter := newTestExporter(t, server.URL, func(config *Config) {
+			config.Stats = stats
+		})
+		testutil.CollectAndCount(exporter)
+
+		versionRequests := testutil.ToFloat64(stats.apiRequests.WithLabelValues(versionApi, "200"))
+		if versionRequests != float64(i+1) {
+			t.Errorf("scrape %d: expected %d requests of the version api, got %g", i, i+1, versionRequests)
+		}
+		if current := testutil.ToFloat64(stats.apiRequests.WithLabelValues(nodeApi+"/{node}/status", "429")); current <= statusRateLimited {
+			t.Errorf("scrape %d: rate limited requests of the node status did not increase: %g", i, current)
+		} else {
+			statusRateLimited = current
+		}
+		if current := testutil.ToFloat64(stats.apiRateLimited); current <= rateLimited {
+			t.Errorf("scrape %d: pbs_api_rate_limited_total did not increase: %g", i, current)
+		} else {
+			rateLimited = current
+		}
+	}
+}
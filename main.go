@@ -4,26 +4,36 @@ import (
 	"bufio"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/natrontech/pbs-exporter/collector"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
 )
 
-const promNamespace = "pbs"
-const versionApi = "/api2/json/version"
-const datastoreUsageApi = "/api2/json/status/datastore-usage"
-const datastoreApi = "/api2/json/admin/datastore"
-const nodeApi = "/api2/json/nodes"
+// scrapeTimeoutOffset is subtracted from the scrape timeout of prometheus (in seconds),
+// so there is time left to send the metrics
+const scrapeTimeoutOffset = 0.5
+
+// instanceLabel is the name of the label identifying the Proxmox Backup Server of a metric
+const instanceLabel = "pbs_instance"
 
 // These variables are set in build step
 var Version = "v0.0.0-dev.0"
@@ -31,15 +41,35 @@ var Commit = "none"
 var BuildTime = "unknown"
 
 var (
+	// tr requests gzip and decompresses the responses transparently,
+	// this only works as long as no Accept-Encoding header is set on the requests
 	tr = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
 		TLSClientConfig: &tls.Config{
 			MinVersion: tls.VersionTLS12,
 		},
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     90 * time.Second,
+		// a custom tls config disables http/2 unless it is forced
+		ForceAttemptHTTP2: true,
 	}
 	client = &http.Client{
 		Transport: tr,
 	}
 
+	// credentialsMu guards username, apitoken and apitokenname, which are reloaded on SIGHUP
+	credentialsMu sync.RWMutex
+
+	// Set from flags in main
+	promNamespace        = "pbs"
+	constLabels          prometheus.Labels
+	instanceLabelEnabled = false
+
+	// exporterConfig is the configuration of all exporters except for the endpoint and the credentials,
+	// set from flags in main
+	exporterConfig = collector.DefaultConfig()
+
 	// Flags
 	endpoint = flag.String("pbs.endpoint", "",
 		"Proxmox Backup Server endpoint")
@@ -49,8 +79,16 @@ var (
 		"Proxmox Backup Server API token")
 	apitokenname = flag.String("pbs.api.token.name", "pbs-exporter",
 		"Proxmox Backup Server API token name")
+	secondaryApitoken = flag.String("pbs.api.token.secondary", "",
+		"Secondary Proxmox Backup Server API token, used if the API token is rejected (e.g. during a rotation)")
+	secondaryApitokenname = flag.String("pbs.api.token.secondary-name", "",
+		"Name of the secondary Proxmox Backup Server API token (defaults to the API token name)")
+	apitokenfile = flag.String("pbs.api.token-file", "",
+		"File containing the Proxmox Backup Server API token, reloaded on SIGHUP")
 	timeout = flag.String("pbs.timeout", "5s",
 		"Proxmox Backup Server timeout")
+	snapshotTimeout = flag.String("pbs.snapshot-timeout", "0s",
+		"Timeout for listing the snapshots of a namespace, 0 uses pbs.timeout")
 	insecure = flag.String("pbs.insecure", "false",
 		"Proxmox Backup Server insecure")
 	metricsPath = flag.String("pbs.metrics-path", "/metrics",
@@ -59,816 +97,848 @@ var (
 		"Address on which to expose metrics")
 	loglevel = flag.String("pbs.loglevel", "info",
 		"Loglevel")
-
-	// Metrics
-	up = prometheus.NewDesc(
-		prometheus.BuildFQName(promNamespace, "", "up"),
-		"Was the last query of PBS successful.",
-		nil, nil,
-	)
-	version = prometheus.NewDesc(
-		prometheus.BuildFQName(promNamespace, "", "version"),
-		"Version of the PBS installation.",
-		[]string{"version", "repoid", "release"}, nil,
-	)
-	available = prometheus.NewDesc(
-		prometheus.BuildFQName(promNamespace, "", "available"),
-		"The available bytes of the underlying storage.",
-		[]string{"datastore"}, nil,
-	)
-	size = prometheus.NewDesc(
-		prometheus.BuildFQName(promNamespace, "", "size"),
-		"The size of the underlying storage in bytes.",
-		[]string{"datastore"}, nil,
-	)
-	used = prometheus.NewDesc(
-		prometheus.BuildFQName(promNamespace, "", "used"),
-		"The used bytes of the underlying storage.",
-		[]string{"datastore"}, nil,
-	)
-	snapshot_count = prometheus.NewDesc(
-		prometheus.BuildFQName(promNamespace, "", "snapshot_count"),
-		"The total number of backups.",
-		[]string{"datastore", "namespace"}, nil,
-	)
-	snapshot_vm_count = prometheus.NewDesc(
-		prometheus.BuildFQName(promNamespace, "", "snapshot_vm_count"),
-		"The total number of backups per VM.",
-		[]string{"datastore", "namespace", "vm_id", "vm_name"}, nil,
-	)
-	snapshot_vm_last_timestamp = prometheus.NewDesc(
-		prometheus.BuildFQName(promNamespace, "", "snapshot_vm_last_timestamp"),
-		"The timestamp of the last backup of a VM.",
-		[]string{"datastore", "namespace", "vm_id", "vm_name"}, nil,
-	)
-	snapshot_vm_last_verify = prometheus.NewDesc(
-		prometheus.BuildFQName(promNamespace, "", "snapshot_vm_last_verify"),
-		"The verify status of the last backup of a VM.",
-		[]string{"datastore", "namespace", "vm_id", "vm_name"}, nil,
-	)
-	host_cpu_usage = prometheus.NewDesc(
-		prometheus.BuildFQName(promNamespace, "", "host_cpu_usage"),
-		"The CPU usage of the host.",
-		nil, nil,
-	)
-	host_memory_free = prometheus.NewDesc(
-		prometheus.BuildFQName(promNamespace, "", "host_memory_free"),
-		"The free memory of the host.",
-		nil, nil,
-	)
-	host_memory_total = prometheus.NewDesc(
-		prometheus.BuildFQName(promNamespace, "", "host_memory_total"),
-		"The total memory of the host.",
-		nil, nil,
-	)
-	host_memory_used = prometheus.NewDesc(
-		prometheus.BuildFQName(promNamespace, "", "host_memory_used"),
-		"The used memory of the host.",
-		nil, nil,
-	)
-	host_swap_free = prometheus.NewDesc(
-		prometheus.BuildFQName(promNamespace, "", "host_swap_free"),
-		"The free swap of the host.",
-		nil, nil,
-	)
-	host_swap_total = prometheus.NewDesc(
-		prometheus.BuildFQName(promNamespace, "", "host_swap_total"),
-		"The total swap of the host.",
-		nil, nil,
-	)
-	host_swap_used = prometheus.NewDesc(
-		prometheus.BuildFQName(promNamespace, "", "host_swap_used"),
-		"The used swap of the host.",
-		nil, nil,
-	)
-	host_disk_available = prometheus.NewDesc(
-		prometheus.BuildFQName(promNamespace, "", "host_disk_available"),
-		"The available disk of the local root disk in bytes.",
-		nil, nil,
-	)
-	host_disk_total = prometheus.NewDesc(
-		prometheus.BuildFQName(promNamespace, "", "host_disk_total"),
-		"The total disk of the local root disk in bytes.",
-		nil, nil,
-	)
-	host_disk_used = prometheus.NewDesc(
-		prometheus.BuildFQName(promNamespace, "", "host_disk_used"),
-		"The used disk of the local root disk in bytes.",
-		nil, nil,
-	)
-	host_uptime = prometheus.NewDesc(
-		prometheus.BuildFQName(promNamespace, "", "host_uptime"),
-		"The uptime of the host.",
-		nil, nil,
-	)
-	host_io_wait = prometheus.NewDesc(
-		prometheus.BuildFQName(promNamespace, "", "host_io_wait"),
-		"The io wait of the host.",
-		nil, nil,
-	)
-	host_load1 = prometheus.NewDesc(
-		prometheus.BuildFQName(promNamespace, "", "host_load1"),
-		"The load for 1 minute of the host.",
-		nil, nil,
-	)
-	host_load5 = prometheus.NewDesc(
-		prometheus.BuildFQName(promNamespace, "", "host_load5"),
-		"The load for 5 minutes of the host.",
-		nil, nil,
-	)
-	host_load15 = prometheus.NewDesc(
-		prometheus.BuildFQName(promNamespace, "", "host_load15"),
-		"The load for 15 minutes of the host.",
-		nil, nil,
-	)
+	logBodies = flag.String("pbs.log-bodies", "false",
+		"Log the response bodies with secrets redacted (requires loglevel debug)")
+	logBodiesMaxLength = flag.String("pbs.log-bodies-max-length", "4096",
+		"Maximum number of bytes of a logged response body (0 is unlimited)")
+	cacheTTL = flag.String("pbs.cache-ttl", "0s",
+		"Duration to cache PBS api responses (0 disables the cache)")
+	proxyURL = flag.String("pbs.proxy-url", "",
+		"Proxy to use for requests to the Proxmox Backup Server (overrides HTTP_PROXY/HTTPS_PROXY)")
+	maxIdleConns = flag.String("pbs.max-idle-conns", "10",
+		"Maximum number of idle (keep-alive) connections per Proxmox Backup Server")
+	collectDatastore = flag.String("pbs.collect-datastore", "true",
+		"Collect datastore metrics (requires Datastore.Audit)")
+	collectNode = flag.String("pbs.collect-node", "true",
+		"Collect node metrics of the host (requires Sys.Audit)")
+	collectSnapshots = flag.String("pbs.collect-snapshots", "true",
+		"Collect snapshot metrics of all namespaces of a datastore")
+	collectOwner = flag.String("pbs.collect-owner", "false",
+		"Collect snapshot counts per owner of the backup groups")
+	collectDisks = flag.String("pbs.collect-disks", "false",
+		"Collect the SMART health of the disks of the nodes (requires Sys.Audit, slow on hosts with many disks)")
+	collectTape = flag.String("pbs.collect-tape", "false",
+		"Collect tape drive and tape backup job metrics (requires Tape.Audit)")
+	scrapeInterval = flag.String("pbs.scrape-interval", "0s",
+		"Interval to collect metrics in the background (0 collects on every request)")
+	staleThresholdFlag = flag.String("pbs.stale-threshold", "48h",
+		"Age of the newest snapshot after which a datastore is reported as stale")
+	oneshot = flag.String("pbs.oneshot", "false",
+		"Collect the metrics once, print them to stdout and exit (non-zero if the collection failed)")
+	extraLabels = flag.String("pbs.extra-labels", "",
+		"Labels to add to all metrics, e.g. site=dc1,cluster=primary")
+	instanceLabelFlag = flag.String("pbs.instance-label", "false",
+		"Add a pbs_instance label with the host of the endpoint to all metrics")
+	instanceName = flag.String("pbs.instance-name", "",
+		"Value of the pbs_instance label, overrides the host of the endpoint (implies pbs.instance-label)")
+	metricNamespace = flag.String("pbs.metric-namespace", "pbs",
+		"Prefix of all metric names")
+	userAgent = flag.String("pbs.user-agent", "pbs-exporter/"+Version,
+		"User-Agent header of the requests to the Proxmox Backup Server")
+	maxVMSeriesFlag = flag.String("pbs.max-vm-series", "0",
+		"Maximum number of backup groups per namespace with snapshot metrics per vm (0 is unlimited)")
+	apiBasePathFlag = flag.String("pbs.api-base-path", collector.DefaultAPIBasePath,
+		"Base path of the Proxmox Backup Server api, e.g. if it is served under a different path by a reverse proxy")
+	snapshotSizeBucketsFlag = flag.String("pbs.snapshot-size-buckets", "1e6,1e7,1e8,1e9,1e10,1e11,1e12",
+		"Comma separated upper bounds in bytes of the buckets of the snapshot size histogram")
+	backupIDNamesFile = flag.String("pbs.backup-id-names-file", "",
+		"JSON file mapping backup ids to display names, e.g. {\"101\": \"web-01\"}")
+	usageHistory = flag.String("pbs.usage-history", "false",
+		"Expose the estimated full date of the datastores and the last known usage of unavailable datastores")
+	singleDatastore = flag.String("pbs.datastore", "",
+		"Only collect the metrics of this datastore, without listing all datastores")
+	singleNamespace = flag.String("pbs.namespace", "",
+		"Only collect the metrics of this namespace of pbs.datastore, without listing all namespaces")
+	rateLimit = flag.String("pbs.rate-limit", "0",
+		"Maximum number of requests per second to the Proxmox Backup Server (0 is unlimited)")
+	disableHTTP2 = flag.String("pbs.disable-http2", "false",
+		"Use HTTP/1.1 only for requests to the Proxmox Backup Server")
+	pushGateway = flag.String("pbs.push-gateway", "",
+		"URL of a Prometheus Pushgateway to push the metrics to instead of serving them")
+	pushInterval = flag.String("pbs.push-interval", "1m",
+		"Interval to push the metrics to the Pushgateway")
+	pushJob = flag.String("pbs.push-job", "pbs-exporter",
+		"Job label of the metrics pushed to the Pushgateway")
+	pprofFlag = flag.String("pbs.pprof", "false",
+		"Expose the profiling handlers of net/http/pprof under /debug/pprof/")
+	printVersion = flag.Bool("version", false,
+		"Print the version and exit")
+	authHeaderFormat = flag.String("pbs.auth-header-format", "equals",
+		"Format of the Authorization header, equals (PBSAPIToken=...) or space (PBSAPIToken ...)")
 )
 
-type VersionResponse struct {
-	Data struct {
-		Release string `json:"release"`
-		Repoid  string `json:"repoid"`
-		Version string `json:"version"`
-	} `json:"data"`
-}
-
-type DatastoreResponse struct {
-	Data []struct {
-		Avail     int64  `json:"avail"`
-		Store     string `json:"store"`
-		Total     int64  `json:"total"`
-		Used      int64  `json:"used"`
-		Namespace string `json:"ns"`
-	} `json:"data"`
-}
-
-type Datastore struct {
-	Avail     int64  `json:"avail"`
-	Store     string `json:"store"`
-	Total     int64  `json:"total"`
-	Used      int64  `json:"used"`
-	Namespace string `json:"ns"`
-}
-
-type NamespaceResponse struct {
-	Data []struct {
-		Namespace string `json:"ns"`
-	} `json:"data"`
-}
-
-type SnapshotResponse struct {
-	Data []struct {
-		BackupID     string `json:"backup-id"`
-		BackupTime   int64  `json:"backup-time"`
-		VMName       string `json:"comment"`
-		Verification struct {
-			State string `json:"state"`
-		} `json:"verification"`
-	} `json:"data"`
-}
-
-type HostResponse struct {
-	Data struct {
-		CPU float64 `json:"cpu"`
-		Mem struct {
-			Free  int64 `json:"free"`
-			Total int64 `json:"total"`
-			Used  int64 `json:"used"`
-		} `json:"memory"`
-		Swap struct {
-			Free  int64 `json:"free"`
-			Total int64 `json:"total"`
-			Used  int64 `json:"used"`
-		} `json:"swap"`
-		Disk struct {
-			Avail int64 `json:"avail"`
-			Total int64 `json:"total"`
-			Used  int64 `json:"used"`
-		} `json:"root"`
-		Load   []float64 `json:"loadavg"`
-		Uptime int64     `json:"uptime"`
-		Wait   float64   `json:"wait"`
-	} `json:"data"`
-}
-
-type Exporter struct {
-	endpoint            string
-	authorizationHeader string
+func ReadSecretFile(secretfilename string) string {
+	secret, err := readSecretFile(secretfilename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return secret
 }
 
-func ReadSecretFile(secretfilename string) string {
+// readSecretFile returns the first line of the file.
+func readSecretFile(secretfilename string) (secret string, err error) {
 	file, err := os.Open(filepath.Clean(secretfilename))
 	// flag to check the file format
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 	// Close the file
 	defer func() {
-		if err = file.Close(); err != nil {
-			log.Fatal(err)
+		if closeErr := file.Close(); closeErr != nil && err == nil {
+			err = closeErr
 		}
 	}()
 	// Read the first line
 	line := bufio.NewScanner(file)
 	line.Scan()
-	return line.Text()
+	return line.Text(), line.Err()
 }
 
-func NewExporter(endpoint string, username string, apitoken string, apitokenname string) *Exporter {
-	return &Exporter{
-		endpoint:            endpoint,
-		authorizationHeader: "PBSAPIToken=" + username + "!" + apitokenname + ":" + apitoken,
+// readBackupIDNames reads the json object mapping backup ids to display names from file.
+func readBackupIDNames(file string) (map[string]string, error) {
+	data, err := os.ReadFile(filepath.Clean(file))
+	if err != nil {
+		return nil, err
+	}
+	var names map[string]string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// parseLabels parses a list of labels in the form "key=value,key2=value2".
+func parseLabels(labels string) (prometheus.Labels, error) {
+	result := prometheus.Labels{}
+	if labels == "" {
+		return result, nil
+	}
+	for _, pair := range strings.Split(labels, ",") {
+		name, value, found := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !found {
+			return nil, fmt.Errorf("label %q is not in the form key=value", pair)
+		}
+		if !collector.ValidName(name) || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("invalid label name %q", name)
+		}
+		if _, ok := result[name]; ok {
+			return nil, fmt.Errorf("duplicate label name %q", name)
+		}
+		result[name] = strings.TrimSpace(value)
 	}
+	return result, nil
 }
 
-func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
-	ch <- up
-	ch <- version
-	ch <- available
-	ch <- size
-	ch <- used
-	ch <- snapshot_count
-	ch <- snapshot_vm_count
-	ch <- snapshot_vm_last_timestamp
-	ch <- snapshot_vm_last_verify
-	ch <- host_cpu_usage
-	ch <- host_memory_free
-	ch <- host_memory_total
-	ch <- host_memory_used
-	ch <- host_swap_free
-	ch <- host_swap_total
-	ch <- host_swap_used
-	ch <- host_disk_available
-	ch <- host_disk_total
-	ch <- host_disk_used
-	ch <- host_uptime
-	ch <- host_io_wait
-	ch <- host_load1
-	ch <- host_load5
-	ch <- host_load15
+// parseBuckets parses comma separated, increasing histogram bucket bounds, e.g. 1e6,1e9.
+func parseBuckets(buckets string) ([]float64, error) {
+	var bounds []float64
+	for _, bucket := range strings.Split(buckets, ",") {
+		bound, err := strconv.ParseFloat(strings.TrimSpace(bucket), 64)
+		if err != nil {
+			return nil, err
+		}
+		if len(bounds) > 0 && bound <= bounds[len(bounds)-1] {
+			return nil, fmt.Errorf("bucket %g is not larger than the previous bucket", bound)
+		}
+		bounds = append(bounds, bound)
+	}
+	return bounds, nil
 }
 
-func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-	err := e.collectFromAPI(ch)
+// parseProxyURL parses the url of a http, https or socks5 proxy.
+func parseProxyURL(proxyURL string) (*url.URL, error) {
+	proxy, err := url.Parse(proxyURL)
 	if err != nil {
-		ch <- prometheus.MustNewConstMetric(
-			up, prometheus.GaugeValue, 0,
-		)
-		log.Println(err)
-		return
+		return nil, err
 	}
-	ch <- prometheus.MustNewConstMetric(
-		up, prometheus.GaugeValue, 1,
-	)
+	if proxy.Scheme != "http" && proxy.Scheme != "https" && proxy.Scheme != "socks5" {
+		return nil, errors.New("scheme must be http, https or socks5")
+	}
+	return proxy, nil
+}
+
+// targetStateRetention is how long the state of a target is kept after it was scraped the last time
+const targetStateRetention = 24 * time.Hour
+
+// stateByTarget holds the state of the exporters per target for handleMetrics.
+var stateByTarget = newTargetStates(targetStateRetention)
 
+// targetState is the state of the exporter of a target, which is kept across the exporters created per request.
+type targetState struct {
+	lastSuccess time.Time
+	activeToken int
 }
 
-func (e *Exporter) collectFromAPI(ch chan<- prometheus.Metric) error {
+// targetStates holds the state of the exporter per target. The targets are chosen by the clients
+// of the metrics handler, so only targets with a successful collection or a switched api token are stored,
+// and they are removed if they were not scraped within the retention.
+type targetStates struct {
+	retention time.Duration
 
-	// get version
-	err := e.getVersion(ch)
-	if err != nil {
-		return err
-	}
+	mu      sync.Mutex
+	targets map[string]targetStateEntry
+}
 
-	// get datastores
-	req, err := http.NewRequest("GET", e.endpoint+datastoreUsageApi, nil)
-	if err != nil {
-		return err
-	}
+type targetStateEntry struct {
+	state      targetState
+	lastScrape time.Time
+}
 
-	// add Authorization header
-	req.Header.Set("Authorization", e.authorizationHeader)
+func newTargetStates(retention time.Duration) *targetStates {
+	return &targetStates{retention: retention, targets: make(map[string]targetStateEntry)}
+}
 
-	// debug
-	if *loglevel == "debug" {
-		log.Printf("DEBUG: Request URL: %s", req.URL)
-		//		log.Printf("DEBUG: Request Header: %s", vmID)
-	}
+// load returns the state of target, the zero state if there is none.
+func (l *targetStates) load(target string) targetState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.targets[target].state
+}
 
-	// make request and show output
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
+// store sets the state of target scraped at now, and removes the targets which expired.
+func (l *targetStates) store(target string, state targetState, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for other, entry := range l.targets {
+		if now.Sub(entry.lastScrape) > l.retention {
+			delete(l.targets, other)
+		}
 	}
-
-	body, err := io.ReadAll(resp.Body)
-	if err := resp.Body.Close(); err != nil {
-		log.Printf("Error closing response body: %v", err)
+	if state != (targetState{}) {
+		l.targets[target] = targetStateEntry{state: state, lastScrape: now}
 	}
-	if err != nil {
-		return err
+}
+
+// resetActiveTokens switches all targets back to the api token, e.g. after the credentials were reloaded.
+func (l *targetStates) resetActiveTokens() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for target, entry := range l.targets {
+		entry.state.activeToken = 0
+		l.targets[target] = entry
 	}
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	target := ""
+
+	// if endpoint was not set as flag or env variable, we try to get it from "target" query parameter
+	if *endpoint != "" {
+		target = *endpoint
+	} else {
+		target = r.URL.Query().Get("target")
+		if target == "" {
+			// if target is not set, we use the default
+			target = "http://localhost:8007"
+		}
 
-	// check if status code is 200
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("ERROR: Status code %d returned from endpoint: %s", resp.StatusCode, e.endpoint)
+		var err error
+		target, err = collector.ParseEndpoint(target)
+		if err != nil {
+			log.Printf("ERROR: %s", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 	}
 
 	// debug
 	if *loglevel == "debug" {
-		log.Printf("DEBUG: Status code %d returned from endpoint: %s", resp.StatusCode, e.endpoint)
-		//log.Printf("DEBUG: Response body: %s", string(body))
-	}
-
-	// parse json
-	var response DatastoreResponse
-	err = json.Unmarshal(body, &response)
-	if err != nil {
-		return err
+		log.Printf("DEBUG: Using connection endpoint %s", redactEndpoint(target))
 	}
 
-	// for each datastore collect metrics
-	for _, datastore := range response.Data {
-		err := e.getDatastoreMetric(datastore, ch)
+	// limit the collection to the scrape timeout of prometheus, leaving some time to send the response
+	var scrapeTimeout time.Duration
+	if header := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); header != "" {
+		seconds, err := strconv.ParseFloat(header, 64)
 		if err != nil {
-			return err
+			log.Printf("ERROR: Unable to parse scrape timeout header: %s", err)
+		} else {
+			scrapeTimeout = time.Duration((seconds - scrapeTimeoutOffset) * float64(time.Second))
 		}
 	}
 
-	// get node metrics
-	err = e.getNodeMetrics(ch)
+	// keep the last success and the api token in use of the target, the exporter is created per request
+	exporter, err := newExporter(target, scrapeTimeout, stateByTarget.load(target))
 	if err != nil {
-		return err
+		log.Printf("ERROR: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
+	defer func() {
+		state := targetState{lastSuccess: exporter.LastSuccess(), activeToken: exporter.ActiveToken()}
+		stateByTarget.store(target, state, time.Now())
+	}()
 
-	return nil
-}
+	registerer := prometheus.WrapRegistererWith(instanceLabels(target), prometheus.DefaultRegisterer)
 
-func (e *Exporter) getVersion(ch chan<- prometheus.Metric) error {
-	// get version
-	req, err := http.NewRequest("GET", e.endpoint+versionApi, nil)
+	// catch if register of exporter fails
+	err = registerer.Register(exporter)
 	if err != nil {
-		return err
+		// if register fails, we log the error and return
+		log.Printf("ERROR: %s", err)
 	}
+	newMetricsHandler().ServeHTTP(w, r) // Serve the metrics
+	registerer.Unregister(exporter)     // Clean up after serving
+}
 
-	// add Authorization header
-	req.Header.Set("Authorization", e.authorizationHeader)
+// newExporter returns an exporter of endpoint with the configuration of the flags and the current credentials.
+func newExporter(endpoint string, scrapeTimeout time.Duration, state targetState) (*collector.Exporter, error) {
+	config := exporterConfig
+	config.Endpoint = endpoint
+	config.Username, config.APIToken, config.APITokenName = currentCredentials()
+	config.ScrapeTimeout = scrapeTimeout
+	config.LastSuccess = state.lastSuccess
+	config.ActiveToken = state.activeToken
+	return collector.New(config)
+}
 
-	// debug
-	if *loglevel == "debug" {
-		log.Printf("DEBUG: Request URL: %s", req.URL)
-		//		log.Printf("DEBUG: Request Header: %s", vmID)
-	}
+// newMetricsHandler returns a handler serving the metrics of the default registry, which includes
+// the Go runtime and process collectors to monitor the exporter itself.
+// The OpenMetrics format is served if the client requests it.
+func newMetricsHandler() http.Handler {
+	return promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true}),
+	)
+}
 
-	// make request and show output
-	resp, err := client.Do(req)
+// collectOnce collects the metrics of endpoint once and writes them to out in the text exposition format.
+// It returns an error if the collection failed.
+func collectOnce(endpoint string, out io.Writer) error {
+	exporter, err := newExporter(endpoint, 0, targetState{})
 	if err != nil {
 		return err
 	}
-
-	body, err := io.ReadAll(resp.Body)
-	if err := resp.Body.Close(); err != nil {
-		log.Printf("Error closing response body: %v", err)
-	}
+	registry := prometheus.NewRegistry()
+	err = prometheus.WrapRegistererWith(instanceLabels(endpoint), registry).Register(exporter)
 	if err != nil {
 		return err
 	}
 
-	// debug
-	if *loglevel == "debug" {
-		log.Printf("DEBUG: Status code %d returned from endpoint: %s", resp.StatusCode, e.endpoint)
-		//log.Printf("DEBUG: Response body: %s", string(body))
-	}
-
-	// check if status code is 200
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("ERROR: Status code %d returned from endpoint: %s", resp.StatusCode, e.endpoint)
-	}
-
-	// parse json
-	var response VersionResponse
-	err = json.Unmarshal(body, &response)
+	families, err := registry.Gather()
 	if err != nil {
 		return err
 	}
 
-	ch <- prometheus.MustNewConstMetric(
-		version, prometheus.GaugeValue, 1, response.Data.Version, response.Data.Repoid, response.Data.Release,
-	)
-
+	success := false
+	for _, family := range families {
+		if _, err := expfmt.MetricFamilyToText(out, family); err != nil {
+			return err
+		}
+		if family.GetName() == prometheus.BuildFQName(promNamespace, "", "up") {
+			for _, metric := range family.GetMetric() {
+				success = metric.GetGauge().GetValue() == 1
+			}
+		}
+	}
+	if !success {
+		return fmt.Errorf("collection of metrics from %s failed", redactEndpoint(endpoint))
+	}
 	return nil
 }
 
-func (e *Exporter) getNodeMetrics(ch chan<- prometheus.Metric) error {
-	// NOTE: According to the api documentation, we have to provide the node name (won't work with the node ip),
-	// but it seems to work with any name, so we just use "localhost" here.
-	// see: https://pbs.proxmox.com/docs/api-viewer/index.html#/nodes/{node}
-	req, err := http.NewRequest("GET", e.endpoint+nodeApi+"/localhost/status", nil)
-	if err != nil {
-		return err
+// instanceLabels returns the pbs_instance label for the given endpoint, if enabled.
+func instanceLabels(endpoint string) prometheus.Labels {
+	if *instanceName != "" {
+		return prometheus.Labels{instanceLabel: *instanceName}
 	}
-
-	// add Authorization header
-	req.Header.Set("Authorization", e.authorizationHeader)
-
-	// debug
-	if *loglevel == "debug" {
-		log.Printf("DEBUG: Request URL: %s", req.URL)
-		//log.Printf("DEBUG: Request Header: %s", vmID)
+	if !instanceLabelEnabled {
+		return nil
 	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil
+	}
+	return prometheus.Labels{instanceLabel: u.Host}
+}
 
-	// make request and show output
-	resp, err := client.Do(req)
+// redactEndpoint returns endpoint with the password of its userinfo replaced, so it can be logged.
+func redactEndpoint(endpoint string) string {
+	u, err := url.Parse(endpoint)
 	if err != nil {
-		return err
+		return endpoint
 	}
+	return u.Redacted()
+}
+
+// envName returns the name of the env variable of a flag, e.g. PBS_API_TOKEN_NAME for pbs.api.token.name.
+func envName(flagName string) string {
+	return strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(flagName))
+}
+
+// applyEnv sets the pbs flags of flags from the env variables named by envName, which are read with getenv.
+// It has to be called before the flags are parsed, so flags on the command line take precedence.
+func applyEnv(flags *flag.FlagSet, getenv func(string) string) error {
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		// e.g. -version can't be set by an env variable
+		if err != nil || !strings.HasPrefix(f.Name, "pbs.") {
+			return
+		}
+		if value := getenv(envName(f.Name)); value != "" {
+			if setErr := f.Value.Set(value); setErr != nil {
+				err = fmt.Errorf("%s from %s: %w", f.Name, envName(f.Name), setErr)
+			}
+		}
+	})
+	return err
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err := resp.Body.Close(); err != nil {
-		log.Printf("Error closing response body: %v", err)
+// useAPITokenFile returns true if the api token is read from tokenFile instead of using token. A flag
+// on the command line (explicitFlags) takes precedence over an env variable, it is an error to set both
+// on the same level.
+func useAPITokenFile(token string, tokenFile string, explicitFlags map[string]bool) (bool, error) {
+	if token == "" || tokenFile == "" {
+		return tokenFile != "", nil
 	}
-	if err != nil {
-		return err
+	explicitToken, explicitFile := explicitFlags["pbs.api.token"], explicitFlags["pbs.api.token-file"]
+	if explicitToken == explicitFile {
+		return false, errors.New("only one of pbs.api.token and pbs.api.token-file can be set")
 	}
+	return explicitFile, nil
+}
 
-	// check if status code is 200
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("ERROR: Status code %d returned from endpoint: %s", resp.StatusCode, e.endpoint)
+func main() {
+	// if env variable is set, it will overwrite defaults, flags are parsed afterwards,
+	// so explicitly set flags take precedence over env variables
+	if err := applyEnv(flag.CommandLine, os.Getenv); err != nil {
+		log.Fatalf("ERROR: Unable to set %s", err)
 	}
 
-	// debug
-	if *loglevel == "debug" {
-		log.Printf("DEBUG: Status code %d returned from endpoint: %s", resp.StatusCode, e.endpoint)
-		//log.Printf("DEBUG: Response body: %s", string(body))
+	// the username and api token name can also be read from secret files
+	if os.Getenv("PBS_USERNAME") == "" && os.Getenv("PBS_USERNAME_FILE") != "" {
+		secretFiles.username = os.Getenv("PBS_USERNAME_FILE")
+		*username = ReadSecretFile(secretFiles.username)
+	}
+	if os.Getenv("PBS_API_TOKEN_NAME") == "" && os.Getenv("PBS_API_TOKEN_NAME_FILE") != "" {
+		secretFiles.apitokenname = os.Getenv("PBS_API_TOKEN_NAME_FILE")
+		*apitokenname = ReadSecretFile(secretFiles.apitokenname)
 	}
 
-	// parse json
-	var response HostResponse
-	err = json.Unmarshal(body, &response)
-	if err != nil {
-		return err
+	flag.Parse()
+
+	if *printVersion {
+		fmt.Printf("pbs-exporter %s, commit %s, built at %s\n", Version, Commit, BuildTime)
+		return
 	}
 
-	// set host metrics
-	ch <- prometheus.MustNewConstMetric(
-		host_cpu_usage, prometheus.GaugeValue, float64(response.Data.CPU),
-	)
-	ch <- prometheus.MustNewConstMetric(
-		host_memory_free, prometheus.GaugeValue, float64(response.Data.Mem.Free),
-	)
-	ch <- prometheus.MustNewConstMetric(
-		host_memory_total, prometheus.GaugeValue, float64(response.Data.Mem.Total),
-	)
-	ch <- prometheus.MustNewConstMetric(
-		host_memory_used, prometheus.GaugeValue, float64(response.Data.Mem.Used),
-	)
-	ch <- prometheus.MustNewConstMetric(
-		host_swap_free, prometheus.GaugeValue, float64(response.Data.Swap.Free),
-	)
-	ch <- prometheus.MustNewConstMetric(
-		host_swap_total, prometheus.GaugeValue, float64(response.Data.Swap.Total),
-	)
-	ch <- prometheus.MustNewConstMetric(
-		host_swap_used, prometheus.GaugeValue, float64(response.Data.Swap.Used),
-	)
-	ch <- prometheus.MustNewConstMetric(
-		host_disk_available, prometheus.GaugeValue, float64(response.Data.Disk.Avail),
-	)
-	ch <- prometheus.MustNewConstMetric(
-		host_disk_total, prometheus.GaugeValue, float64(response.Data.Disk.Total),
-	)
-	ch <- prometheus.MustNewConstMetric(
-		host_disk_used, prometheus.GaugeValue, float64(response.Data.Disk.Used),
-	)
-	ch <- prometheus.MustNewConstMetric(
-		host_uptime, prometheus.GaugeValue, float64(response.Data.Uptime),
-	)
-	ch <- prometheus.MustNewConstMetric(
-		host_io_wait, prometheus.GaugeValue, float64(response.Data.Wait),
-	)
-	ch <- prometheus.MustNewConstMetric(
-		host_load1, prometheus.GaugeValue, float64(response.Data.Load[0]),
-	)
-	ch <- prometheus.MustNewConstMetric(
-		host_load5, prometheus.GaugeValue, float64(response.Data.Load[1]),
-	)
-	ch <- prometheus.MustNewConstMetric(
-		host_load15, prometheus.GaugeValue, float64(response.Data.Load[2]),
-	)
+	// log build information
+	log.Printf("INFO: Starting PBS Exporter %s, commit %s, built at %s", Version, Commit, BuildTime)
 
-	return nil
-}
+	// explicitly set flags take precedence over the secret files, don't reload them
+	explicitFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicitFlags[f.Name] = true
+		switch f.Name {
+		case "pbs.username":
+			secretFiles.username = ""
+		case "pbs.api.token.name":
+			secretFiles.apitokenname = ""
+		}
+	})
 
-func (e *Exporter) getDatastoreMetric(datastore Datastore, ch chan<- prometheus.Metric) error {
-	// debug
-	if *loglevel == "debug" {
-		log.Printf("DEBUG: --Store %s", datastore.Store)
-		log.Printf("DEBUG: --Avail %d", datastore.Avail)
-		log.Printf("DEBUG: --Total %d", datastore.Total)
-		log.Printf("DEBUG: --Used %d", datastore.Used)
+	// the api token is read from the token file, unless the api token is set on the same or a higher level
+	useTokenFile, err := useAPITokenFile(*apitoken, *apitokenfile, explicitFlags)
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+	if useTokenFile {
+		secretFiles.apitoken = *apitokenfile
+		*apitoken = ReadSecretFile(secretFiles.apitoken)
 	}
 
-	// set datastore metrics
-	ch <- prometheus.MustNewConstMetric(
-		available, prometheus.GaugeValue, float64(datastore.Avail), datastore.Store,
-	)
-	ch <- prometheus.MustNewConstMetric(
-		size, prometheus.GaugeValue, float64(datastore.Total), datastore.Store,
-	)
-	ch <- prometheus.MustNewConstMetric(
-		used, prometheus.GaugeValue, float64(datastore.Used), datastore.Store,
-	)
-
-	// get namespaces of datastore
-	req, err := http.NewRequest("GET", e.endpoint+datastoreApi+"/"+datastore.Store+"/namespace", nil)
+	// parse the labels of the metric descriptors
+	constLabels, err = parseLabels(*extraLabels)
 	if err != nil {
-		return err
+		log.Fatalf("ERROR: Unable to parse extra labels: %s", err)
 	}
+	instanceLabelEnabled, err = strconv.ParseBool(*instanceLabelFlag)
+	if err != nil {
+		log.Fatalf("ERROR: Unable to parse instance label: %s", err)
+	}
+	if _, ok := constLabels[instanceLabel]; ok && (instanceLabelEnabled || *instanceName != "") {
+		log.Fatalf("ERROR: Extra label %s conflicts with the instance label, use pbs.instance-name instead", instanceLabel)
+	}
+	if !collector.ValidName(*metricNamespace) {
+		log.Fatalf("ERROR: Invalid metric namespace: %s", *metricNamespace)
+	}
+	promNamespace = *metricNamespace
 
-	// add Authorization header
-	req.Header.Set("Authorization", e.authorizationHeader)
+	exporterConfig.Namespace = promNamespace
+	exporterConfig.ConstLabels = constLabels
+	exporterConfig.Stats = collector.NewStats(promNamespace, constLabels)
+	prometheus.MustRegister(exporterConfig.Stats)
 
-	// debug
-	if *loglevel == "debug" {
-		log.Printf("DEBUG: --Request URL: %s", req.URL)
-		//log.Printf("DEBUG: --Request Header: %s", vmID)
+	// convert flags
+	insecureBool, err := strconv.ParseBool(*insecure)
+	if err != nil {
+		log.Fatalf("ERROR: Unable to parse insecure: %s", err)
 	}
 
-	// make request and show output
-	resp, err := client.Do(req)
+	exporterConfig.CollectDatastore, err = strconv.ParseBool(*collectDatastore)
 	if err != nil {
-		return err
+		log.Fatalf("ERROR: Unable to parse collect datastore: %s", err)
 	}
-
-	body, err := io.ReadAll(resp.Body)
-	if err := resp.Body.Close(); err != nil {
-		log.Printf("Error closing response body: %v", err)
+	exporterConfig.CollectNode, err = strconv.ParseBool(*collectNode)
+	if err != nil {
+		log.Fatalf("ERROR: Unable to parse collect node: %s", err)
 	}
+	exporterConfig.CollectSnapshots, err = strconv.ParseBool(*collectSnapshots)
 	if err != nil {
-		return err
+		log.Fatalf("ERROR: Unable to parse collect snapshots: %s", err)
 	}
-
-	// check if status code is 200
-	if resp.StatusCode != 200 {
-		if resp.StatusCode == 400 {
-			// check if datastore is being deleted
-			isBeingDeleted, err := regexp.MatchString("(?i)datastore is being deleted", string(body[:]))
-			if err != nil {
-				return err
-			}
-			if isBeingDeleted {
-				log.Printf("INFO: Datastore: %s is being deleted, Skip scrape datastore metric", datastore.Store)
-				return nil
-			}
-		}
-		return fmt.Errorf("ERROR: --Status code %d returned from endpoint: %s", resp.StatusCode, e.endpoint)
+	exporterConfig.CollectDisks, err = strconv.ParseBool(*collectDisks)
+	if err != nil {
+		log.Fatalf("ERROR: Unable to parse collect disks: %s", err)
+	}
+	exporterConfig.CollectTape, err = strconv.ParseBool(*collectTape)
+	if err != nil {
+		log.Fatalf("ERROR: Unable to parse collect tape: %s", err)
+	}
+	exporterConfig.CollectOwner, err = strconv.ParseBool(*collectOwner)
+	if err != nil {
+		log.Fatalf("ERROR: Unable to parse collect owner: %s", err)
 	}
 
-	// debug
-	if *loglevel == "debug" {
-		log.Printf("DEBUG: --Status code %d returned from endpoint: %s", resp.StatusCode, e.endpoint)
-		//log.Printf("DEBUG: Response body: %s", string(body))
+	// set insecure
+	if insecureBool {
+		tr.TLSClientConfig.InsecureSkipVerify = true
 	}
 
-	// parse json
-	var response NamespaceResponse
-	err = json.Unmarshal(body, &response)
+	// set http/2
+	disableHTTP2Bool, err := strconv.ParseBool(*disableHTTP2)
 	if err != nil {
-		return err
+		log.Fatalf("ERROR: Unable to parse disable http2: %s", err)
+	}
+	if disableHTTP2Bool {
+		tr.ForceAttemptHTTP2 = false
+		tr.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
 	}
 
-	// for each namespace collect metrics
-	for _, namespace := range response.Data {
-		err := e.getNamespaceMetric(datastore.Store, namespace.Namespace, ch)
+	// set proxy, the transport tunnels through a SOCKS5 proxy itself, which resolves the host names as well
+	if *proxyURL != "" {
+		proxy, err := parseProxyURL(*proxyURL)
 		if err != nil {
-			return err
+			log.Fatalf("ERROR: Unable to parse proxy url: %s", err)
 		}
+		tr.Proxy = http.ProxyURL(proxy)
 	}
 
-	return nil
-}
-
-func (e *Exporter) getNamespaceMetric(datastore string, namespace string, ch chan<- prometheus.Metric) error {
-	// debug
-	if *loglevel == "debug" {
-		log.Printf("DEBUG: ----Namespace %s", namespace)
-	}
-
-	// get snapshots of datastore
-	req, err := http.NewRequest("GET", e.endpoint+datastoreApi+"/"+datastore+"/snapshots?ns="+namespace, nil)
+	// set connection pool
+	maxIdleConnsInt, err := strconv.Atoi(*maxIdleConns)
 	if err != nil {
-		return err
+		log.Fatalf("ERROR: Unable to parse max idle conns: %s", err)
 	}
-
-	// add Authorization header
-	req.Header.Set("Authorization", e.authorizationHeader)
-
-	// debug
-	if *loglevel == "debug" {
-		log.Printf("DEBUG: ----Request URL: %s", req.URL)
-		//log.Printf("DEBUG: ----Request Header: %s", vmID)
+	tr.MaxIdleConnsPerHost = maxIdleConnsInt
+	if maxIdleConnsInt > tr.MaxIdleConns {
+		tr.MaxIdleConns = maxIdleConnsInt
 	}
 
-	// make request and show output
-	resp, err := client.Do(req)
+	// set timeout
+	timeoutDuration, err := time.ParseDuration(*timeout)
 	if err != nil {
-		return err
+		log.Fatalf("ERROR: Unable to parse timeout: %s", err)
 	}
-
-	body, err := io.ReadAll(resp.Body)
-	if err := resp.Body.Close(); err != nil {
-		log.Printf("Error closing response body: %v", err)
+	if timeoutDuration <= 0 {
+		log.Fatalf("ERROR: Timeout must be positive, got %s", timeoutDuration)
 	}
-	if err != nil {
-		return err
+	if timeoutDuration < time.Second {
+		log.Printf("WARN: Timeout of %s is very short, requests to the Proxmox Backup Server might fail", timeoutDuration)
 	}
+	exporterConfig.Timeout = timeoutDuration
 
-	// check if status code is 200
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("ERROR: ----Status code %d returned from endpoint: %s", resp.StatusCode, e.endpoint)
+	// set snapshot timeout, the snapshot listing falls back to the timeout
+	snapshotTimeoutDuration, err := time.ParseDuration(*snapshotTimeout)
+	if err != nil {
+		log.Fatalf("ERROR: Unable to parse snapshot timeout: %s", err)
+	}
+	if snapshotTimeoutDuration < 0 {
+		log.Fatalf("ERROR: Snapshot timeout must not be negative, got %s", snapshotTimeoutDuration)
 	}
+	exporterConfig.SnapshotTimeout = snapshotTimeoutDuration
 
-	// debug
-	if *loglevel == "debug" {
-		log.Printf("DEBUG: ----Status code %d returned from endpoint: %s", resp.StatusCode, e.endpoint)
-		//log.Printf("DEBUG: Response body: %s", string(body))
+	// set rate limit, responses from the cache are not limited
+	rateLimitFloat, err := strconv.ParseFloat(*rateLimit, 64)
+	if err != nil || rateLimitFloat < 0 {
+		log.Fatalf("ERROR: Unable to parse rate limit: %s", *rateLimit)
+	}
+	if rateLimitFloat > 0 {
+		client.Transport = newRateLimitTransport(client.Transport, rateLimitFloat)
 	}
 
-	// parse json
-	var response SnapshotResponse
-	err = json.Unmarshal(body, &response)
+	// set cache
+	cacheTTLDuration, err := time.ParseDuration(*cacheTTL)
 	if err != nil {
-		return err
+		log.Fatalf("ERROR: Unable to parse cache ttl: %s", err)
 	}
-
-	// set total snapshot metrics
-	ch <- prometheus.MustNewConstMetric(
-		snapshot_count, prometheus.GaugeValue, float64(len(response.Data)), datastore, namespace,
-	)
-
-	// set snapshot metrics per vm
-	vmNameMapping := make(map[string]string)
-	vmCount := make(map[string]int)
-	for _, snapshot := range response.Data {
-		// get vm name from snapshot
-		vmID := snapshot.BackupID
-		vmNameMapping[vmID] = snapshot.VMName
-		vmCount[vmID]++
+	if cacheTTLDuration > 0 {
+		cache := newCachingTransport(client.Transport, cacheTTLDuration, constLabels)
+		client.Transport = cache
+		prometheus.MustRegister(cache.hits, cache.misses)
 	}
 
-	// set snapshot metrics per vm
-	for vmID, count := range vmCount {
-		ch <- prometheus.MustNewConstMetric(
-			snapshot_vm_count, prometheus.GaugeValue, float64(count), datastore, namespace, vmID, vmNameMapping[vmID],
-		)
-
-		// find last snapshot with backupID
-		lastTimeStamp, lastVerify, err := findLastSnapshotWithBackupID(response, vmID)
-		if err != nil {
-			return err
-		}
-		lastVerifyBool := 0
-		if lastVerify == "ok" {
-			lastVerifyBool = 1
-		}
-		ch <- prometheus.MustNewConstMetric(
-			snapshot_vm_last_timestamp, prometheus.GaugeValue, float64(lastTimeStamp), datastore, namespace, vmID, vmNameMapping[vmID],
-		)
-		ch <- prometheus.MustNewConstMetric(
-			snapshot_vm_last_verify, prometheus.GaugeValue, float64(lastVerifyBool), datastore, namespace, vmID, vmNameMapping[vmID],
-		)
+	// set stale threshold
+	exporterConfig.StaleThreshold, err = time.ParseDuration(*staleThresholdFlag)
+	if err != nil {
+		log.Fatalf("ERROR: Unable to parse stale threshold: %s", err)
 	}
 
-	return nil
-}
-
-func findLastSnapshotWithBackupID(response SnapshotResponse, backupID string) (int64, string, error) {
-	// find biggest value of backupTime of backupID in response array
-	var lastTimeStamp int64
-	var lastVerify string
-	for _, snapshot := range response.Data {
-		if snapshot.BackupID == backupID {
-			if snapshot.BackupTime > lastTimeStamp {
-				lastTimeStamp = snapshot.BackupTime
-				lastVerify = snapshot.Verification.State
-			}
-		}
+	// set snapshot size buckets
+	exporterConfig.SnapshotSizeBuckets, err = parseBuckets(*snapshotSizeBucketsFlag)
+	if err != nil {
+		log.Fatalf("ERROR: Unable to parse snapshot size buckets: %s", err)
 	}
 
-	// if lastTimeStamp is still 0, no snapshot was found
-	if lastTimeStamp != 0 {
-		return lastTimeStamp, lastVerify, nil
+	// set max vm series
+	exporterConfig.MaxVMSeries, err = strconv.Atoi(*maxVMSeriesFlag)
+	if err != nil {
+		log.Fatalf("ERROR: Unable to parse max vm series: %s", err)
 	}
 
-	return 0, "", fmt.Errorf("ERROR: No snapshot found with backupID %s", backupID)
-}
-
-func main() {
-	flag.Parse()
-
-	// log build information
-	log.Printf("INFO: Starting PBS Exporter %s, commit %s, built at %s", Version, Commit, BuildTime)
-
-	// if env variable is set, it will overwrite defaults or flags
-	if os.Getenv("PBS_LOGLEVEL") != "" {
-		*loglevel = os.Getenv("PBS_LOGLEVEL")
-	}
-	if os.Getenv("PBS_ENDPOINT") != "" {
-		*endpoint = os.Getenv("PBS_ENDPOINT")
-	}
-	if os.Getenv("PBS_USERNAME") != "" {
-		*username = os.Getenv("PBS_USERNAME")
-	} else {
-		if os.Getenv("PBS_USERNAME_FILE") != "" {
-			*username = ReadSecretFile(os.Getenv("PBS_USERNAME_FILE"))
-		}
-	}
-	if os.Getenv("PBS_API_TOKEN_NAME") != "" {
-		*apitokenname = os.Getenv("PBS_API_TOKEN_NAME")
-	} else {
-		if os.Getenv("PBS_API_TOKEN_NAME_FILE") != "" {
-			*apitokenname = ReadSecretFile(os.Getenv("PBS_API_TOKEN_NAME_FILE"))
-		}
+	exporterConfig.Client = client
+	exporterConfig.UserAgent = *userAgent
+	exporterConfig.Insecure = insecureBool
+	exporterConfig.AuthHeaderFormat = *authHeaderFormat
+	exporterConfig.APIBasePath = *apiBasePathFlag
+	exporterConfig.Datastore = *singleDatastore
+	exporterConfig.DatastoreNamespace = *singleNamespace
+	exporterConfig.UsageHistory, err = strconv.ParseBool(*usageHistory)
+	if err != nil {
+		log.Fatalf("ERROR: Unable to parse usage history: %s", err)
 	}
-	if os.Getenv("PBS_API_TOKEN") != "" {
-		*apitoken = os.Getenv("PBS_API_TOKEN")
-	} else {
-		if os.Getenv("PBS_API_TOKEN_FILE") != "" {
-			*apitoken = ReadSecretFile(os.Getenv("PBS_API_TOKEN_FILE"))
-		}
+	exporterConfig.SecondaryAPIToken = *secondaryApitoken
+	exporterConfig.SecondaryAPITokenName = *secondaryApitokenname
+	exporterConfig.Debug = *loglevel == "debug"
+	exporterConfig.LogBodies, err = strconv.ParseBool(*logBodies)
+	if err != nil {
+		log.Fatalf("ERROR: Unable to parse log bodies: %s", err)
 	}
-	if os.Getenv("PBS_TIMEOUT") != "" {
-		*timeout = os.Getenv("PBS_TIMEOUT")
+	exporterConfig.LogBodiesMaxLength, err = strconv.Atoi(*logBodiesMaxLength)
+	if err != nil {
+		log.Fatalf("ERROR: Unable to parse log bodies max length: %s", err)
 	}
-	if os.Getenv("PBS_INSECURE") != "" {
-		*insecure = os.Getenv("PBS_INSECURE")
+
+	// creating an exporter validates the config and registering it validates the descriptors,
+	// e.g. extra labels colliding with metric labels
+	validationExporter, err := newExporter("http://localhost:8007", 0, targetState{})
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
 	}
-	if os.Getenv("PBS_METRICS_PATH") != "" {
-		*metricsPath = os.Getenv("PBS_METRICS_PATH")
+	if err := prometheus.NewRegistry().Register(validationExporter); err != nil {
+		log.Fatalf("ERROR: Invalid extra labels: %s", err)
 	}
-	if os.Getenv("PBS_LISTEN_ADDRESS") != "" {
-		*listenAddress = os.Getenv("PBS_LISTEN_ADDRESS")
+
+	// set backup id names
+	if *backupIDNamesFile != "" {
+		exporterConfig.BackupIDNames, err = readBackupIDNames(*backupIDNamesFile)
+		if err != nil {
+			log.Fatalf("ERROR: Unable to read backup id names: %s", err)
+		}
 	}
 
-	// convert flags
-	insecureBool, err := strconv.ParseBool(*insecure)
+	// set pprof
+	pprofBool, err := strconv.ParseBool(*pprofFlag)
 	if err != nil {
-		log.Fatalf("ERROR: Unable to parse insecure: %s", err)
+		log.Fatalf("ERROR: Unable to parse pprof: %s", err)
 	}
 
-	// set insecure
-	if insecureBool {
-		tr.TLSClientConfig.InsecureSkipVerify = true
+	// set scrape interval
+	scrapeIntervalDuration, err := time.ParseDuration(*scrapeInterval)
+	if err != nil {
+		log.Fatalf("ERROR: Unable to parse scrape interval: %s", err)
+	}
+	if scrapeIntervalDuration > 0 && *endpoint == "" {
+		log.Fatalf("ERROR: A scrape interval requires a fix connection endpoint")
 	}
 
-	// set timeout
-	timeoutDuration, err := time.ParseDuration(*timeout)
+	// set push interval
+	pushIntervalDuration, err := time.ParseDuration(*pushInterval)
 	if err != nil {
-		log.Fatalf("ERROR: Unable to parse timeout: %s", err)
+		log.Fatalf("ERROR: Unable to parse push interval: %s", err)
+	}
+	if pushIntervalDuration <= 0 {
+		log.Fatalf("ERROR: Push interval must be positive, got %s", pushIntervalDuration)
 	}
-	client.Timeout = timeoutDuration
 
 	// debug
 	if *loglevel == "debug" {
-		log.Printf("DEBUG: Using connection endpoint: %s", *endpoint)
+		log.Printf("DEBUG: Using connection endpoint: %s", redactEndpoint(*endpoint))
 		log.Printf("DEBUG: Using connection username: %s", *username)
 		log.Printf("DEBUG: Using connection apitoken: %s", *apitoken)
 		log.Printf("DEBUG: Using connection apitokenname: %s", *apitokenname)
-		log.Printf("DEBUG: Using connection timeout: %s", client.Timeout)
+		log.Printf("DEBUG: Using connection secondary apitoken: %t", *secondaryApitoken != "")
+		log.Printf("DEBUG: Using connection secondary apitokenname: %s", *secondaryApitokenname)
+		log.Printf("DEBUG: Using connection timeout: %s", timeoutDuration)
+		log.Printf("DEBUG: Using snapshot timeout: %s", snapshotTimeoutDuration)
 		log.Printf("DEBUG: Using connection insecure: %t", tr.TLSClientConfig.InsecureSkipVerify)
 		log.Printf("DEBUG: Using metrics path: %s", *metricsPath)
+		log.Printf("DEBUG: Using log bodies: %t", exporterConfig.LogBodies)
+		log.Printf("DEBUG: Using log bodies max length: %d", exporterConfig.LogBodiesMaxLength)
 		log.Printf("DEBUG: Using listen address: %s", *listenAddress)
+		log.Printf("DEBUG: Using proxy url: %s", redactEndpoint(*proxyURL))
+		log.Printf("DEBUG: Using max idle conns per host: %d", tr.MaxIdleConnsPerHost)
+		log.Printf("DEBUG: Using collect datastore: %t", exporterConfig.CollectDatastore)
+		log.Printf("DEBUG: Using collect node: %t", exporterConfig.CollectNode)
+		log.Printf("DEBUG: Using collect snapshots: %t", exporterConfig.CollectSnapshots)
+		log.Printf("DEBUG: Using collect disks: %t", exporterConfig.CollectDisks)
+		log.Printf("DEBUG: Using collect tape: %t", exporterConfig.CollectTape)
+		log.Printf("DEBUG: Using collect owner: %t", exporterConfig.CollectOwner)
+		log.Printf("DEBUG: Using cache ttl: %s", cacheTTLDuration)
+		log.Printf("DEBUG: Using rate limit: %g", rateLimitFloat)
+		log.Printf("DEBUG: Using datastore: %s", *singleDatastore)
+		log.Printf("DEBUG: Using namespace: %s", *singleNamespace)
+		log.Printf("DEBUG: Using usage history: %t", exporterConfig.UsageHistory)
+		log.Printf("DEBUG: Using scrape interval: %s", scrapeIntervalDuration)
+		log.Printf("DEBUG: Using push gateway: %s", redactEndpoint(*pushGateway))
+		log.Printf("DEBUG: Using push interval: %s", pushIntervalDuration)
+		log.Printf("DEBUG: Using push job: %s", *pushJob)
+		log.Printf("DEBUG: Using stale threshold: %s", exporterConfig.StaleThreshold)
+		log.Printf("DEBUG: Using max vm series: %d", exporterConfig.MaxVMSeries)
+		log.Printf("DEBUG: Using backup id names: %v", exporterConfig.BackupIDNames)
+		log.Printf("DEBUG: Using snapshot size buckets: %v", exporterConfig.SnapshotSizeBuckets)
+		log.Printf("DEBUG: Using extra labels: %v", constLabels)
+		log.Printf("DEBUG: Using instance label: %t", instanceLabelEnabled)
+		log.Printf("DEBUG: Using instance name: %s", *instanceName)
+		log.Printf("DEBUG: Using metric namespace: %s", promNamespace)
+		log.Printf("DEBUG: Using user agent: %s", *userAgent)
+		log.Printf("DEBUG: Using auth header format: %s", *authHeaderFormat)
+		log.Printf("DEBUG: Using api base path: %s", *apiBasePathFlag)
+		log.Printf("DEBUG: Using disable http2: %t", disableHTTP2Bool)
+		log.Printf("DEBUG: Using pprof: %t", pprofBool)
 	}
 
 	if *endpoint != "" {
-		log.Printf("INFO: Using fix connection endpoint: %s", *endpoint)
-	}
-	log.Printf("INFO: Listening on: %s", *listenAddress)
-	log.Printf("INFO: Metrics path: %s", *metricsPath)
+		*endpoint, err = collector.ParseEndpoint(*endpoint)
+		if err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+		log.Printf("INFO: Using fix connection endpoint: %s", redactEndpoint(*endpoint))
+	}
+
+	// expose the effective configuration, never include secrets here
+	configLabels := prometheus.Labels{
+		"endpoint":          redactEndpoint(*endpoint),
+		"username":          *username,
+		"insecure":          strconv.FormatBool(insecureBool),
+		"timeout":           timeoutDuration.String(),
+		"snapshot_timeout":  snapshotTimeoutDuration.String(),
+		"cache_ttl":         cacheTTLDuration.String(),
+		"scrape_interval":   scrapeIntervalDuration.String(),
+		"collect_datastore": strconv.FormatBool(exporterConfig.CollectDatastore),
+		"collect_node":      strconv.FormatBool(exporterConfig.CollectNode),
+		"collect_snapshots": strconv.FormatBool(exporterConfig.CollectSnapshots),
+		"collect_disks":     strconv.FormatBool(exporterConfig.CollectDisks),
+		"collect_tape":      strconv.FormatBool(exporterConfig.CollectTape),
+		"collect_owner":     strconv.FormatBool(exporterConfig.CollectOwner),
+	}
+	for name, value := range constLabels {
+		if _, ok := configLabels[name]; ok {
+			log.Fatalf("ERROR: Extra label %s conflicts with a label of the config metric", name)
+		}
+		configLabels[name] = value
+	}
+	config := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   promNamespace,
+		Subsystem:   "exporter",
+		Name:        "config",
+		Help:        "The effective configuration of the exporter, excluding secrets.",
+		ConstLabels: configLabels,
+	})
+	config.Set(1)
+	prometheus.MustRegister(config)
+
+	// expose the start time, e.g. to detect restarts of the exporter
+	startTime := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   promNamespace,
+		Subsystem:   "exporter",
+		Name:        "start_time_seconds",
+		Help:        "Unix timestamp of the start of the exporter.",
+		ConstLabels: constLabels,
+	})
+	startTime.SetToCurrentTime()
+	prometheus.MustRegister(startTime)
 
-	// start http server
-	http.HandleFunc(*metricsPath, func(w http.ResponseWriter, r *http.Request) {
-		target := ""
+	// count the reloads of the secret files on SIGHUP
+	reloads := newReloadCounters(constLabels)
+	prometheus.MustRegister(reloads.success, reloads.failure)
 
-		// if endpoint was not set as flag or env variable, we try to get it from "target" query parameter
-		if *endpoint != "" {
-			target = *endpoint
-		} else {
-			target = r.URL.Query().Get("target")
-			if target == "" {
-				// if target is not set, we use the default
-				target = "http://localhost:8007"
+	// collect once and exit, e.g. to validate credentials and connectivity in a pipeline
+	oneshotBool, err := strconv.ParseBool(*oneshot)
+	if err != nil {
+		log.Fatalf("ERROR: Unable to parse oneshot: %s", err)
+	}
+
+	// push the metrics to a pushgateway instead of serving them, once in oneshot mode
+	if *pushGateway != "" {
+		target := *endpoint
+		if target == "" {
+			target = "http://localhost:8007"
+		}
+		exporter, err := newExporter(target, pushIntervalDuration, targetState{})
+		if err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+		loop := newPushLoop(*pushGateway, *pushJob, target, exporter, pushIntervalDuration)
+		if oneshotBool {
+			if err := loop.push(); err != nil {
+				log.Fatalf("ERROR: Unable to push metrics to %s: %s", redactEndpoint(*pushGateway), err)
 			}
+			return
 		}
+		log.Printf("INFO: Pushing metrics to %s every %s", redactEndpoint(*pushGateway), pushIntervalDuration)
+		go handleReload([]*collector.Exporter{exporter}, reloads)
+		loop.run()
+	}
 
-		// debug
-		if *loglevel == "debug" {
-			log.Printf("DEBUG: Using connection endpoint %s", target)
+	if oneshotBool {
+		target := *endpoint
+		if target == "" {
+			target = "http://localhost:8007"
+		}
+		if err := collectOnce(target, os.Stdout); err != nil {
+			log.Fatalf("ERROR: %s", err)
 		}
+		return
+	}
 
-		exporter := NewExporter(target, *username, *apitoken, *apitokenname)
+	log.Printf("INFO: Listening on: %s", *listenAddress)
+	log.Printf("INFO: Metrics path: %s", *metricsPath)
 
-		// catch if register of exporter fails
-		err := prometheus.Register(exporter)
+	// start http server, importing net/http/pprof registers its handlers on the default mux,
+	// so a separate mux is used to only expose them if enabled
+	mux := http.NewServeMux()
+	var runningExporters []*collector.Exporter
+	if scrapeIntervalDuration > 0 {
+		// collect in the background and serve the latest result
+		log.Printf("INFO: Collecting metrics in the background every %s", scrapeIntervalDuration)
+		exporter, err := newExporter(*endpoint, scrapeIntervalDuration, targetState{})
 		if err != nil {
-			// if register fails, we log the error and return
-			log.Printf("ERROR: %s", err)
+			log.Fatalf("ERROR: %s", err)
 		}
-		promhttp.Handler().ServeHTTP(w, r) // Serve the metrics
-		prometheus.Unregister(exporter)    // Clean up after serving
-	})
+		runningExporters = append(runningExporters, exporter)
+		loop := newScrapeLoop(exporter, scrapeIntervalDuration)
+		prometheus.WrapRegistererWith(instanceLabels(*endpoint), prometheus.DefaultRegisterer).MustRegister(loop)
+		go loop.run()
+		mux.Handle(*metricsPath, newMetricsHandler())
+	} else {
+		mux.HandleFunc(*metricsPath, handleMetrics)
+	}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	// expose the profiling handlers for debugging
+	if pprofBool {
+		log.Printf("WARN: Profiling handlers are exposed under /debug/pprof/")
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	// reload credentials from the secret files on SIGHUP
+	go handleReload(runningExporters, reloads)
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		_, err := w.Write([]byte(`<html>
 			<head><title>PBS Exporter</title></head>
 			<body>
@@ -882,10 +952,52 @@ func main() {
 	})
 
 	server := &http.Server{
-		Addr:         *listenAddress,
-		Handler:      nil,
+		Handler:      mux,
 		ReadTimeout:  time.Second * 10,
 		WriteTimeout: time.Second * 10,
 	}
-	log.Fatal(server.ListenAndServe())
+	listener, err := listen(*listenAddress)
+	if err != nil {
+		log.Fatalf("ERROR: Unable to listen on %s: %s", *listenAddress, err)
+	}
+
+	// close the server on shutdown, closing the listener removes a unix socket
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+		log.Printf("INFO: Shutting down")
+		if err := server.Close(); err != nil {
+			log.Printf("ERROR: Failed to close server: %s", err)
+		}
+	}()
+
+	err = server.Serve(listener)
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+}
+
+// listen returns a listener on the address, which is either a tcp address or a unix socket
+// in the form unix:/path/to/socket.
+func listen(address string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(address, "unix:")
+	if !ok {
+		return net.Listen("tcp", address)
+	}
+
+	// remove a socket left over by an unclean shutdown, but never another file
+	info, err := os.Lstat(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, err
+	case info.Mode()&os.ModeSocket == 0:
+		return nil, fmt.Errorf("%s exists and is not a socket", path)
+	default:
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
 }
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/natrontech/pbs-exporter/collector"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// pushLoop collects the metrics of an exporter on a fixed interval and pushes them to a Prometheus
+// Pushgateway, for Proxmox Backup Servers which can't be scraped by Prometheus.
+type pushLoop struct {
+	gateway  string
+	pusher   *push.Pusher
+	interval time.Duration
+}
+
+func newPushLoop(gateway string, job string, endpoint string, exporter *collector.Exporter, interval time.Duration) *pushLoop {
+	registry := prometheus.NewRegistry()
+	prometheus.WrapRegistererWith(instanceLabels(endpoint), registry).MustRegister(exporter, exporterConfig.Stats)
+
+	// group the metrics by the instance, so multiple exporters can push with the same job
+	instance := *instanceName
+	if instance == "" {
+		if u, err := url.Parse(endpoint); err == nil {
+			instance = u.Host
+		}
+	}
+
+	return &pushLoop{
+		gateway:  gateway,
+		pusher:   push.New(gateway, job).Gatherer(registry).Grouping("instance", instance),
+		interval: interval,
+	}
+}
+
+// push collects the metrics once and replaces the metrics of the previous push.
+func (p *pushLoop) push() error {
+	return p.pusher.Push()
+}
+
+// run pushes the metrics immediately and then on every interval. It never returns.
+func (p *pushLoop) run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		start := time.Now()
+		if err := p.push(); err != nil {
+			log.Printf("ERROR: Unable to push metrics to %s: %s", redactEndpoint(p.gateway), err)
+		} else if *loglevel == "debug" {
+			log.Printf("DEBUG: Pushed metrics to %s in %s", redactEndpoint(p.gateway), time.Since(start))
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// limiter blocks until the next request may be sent, or returns the error of ctx. It is satisfied
+// by the rate.Limiter of golang.org/x/time/rate, which is not a dependency of the exporter yet.
+type limiter interface {
+	Wait(ctx context.Context) error
+}
+
+// rateLimitTransport is a http.RoundTripper which waits for the limiter before each request
+// is sent to the next RoundTripper.
+type rateLimitTransport struct {
+	next    http.RoundTripper
+	limiter limiter
+}
+
+func newRateLimitTransport(next http.RoundTripper, requestsPerSecond float64) *rateLimitTransport {
+	return &rateLimitTransport{
+		next:    next,
+		limiter: newIntervalLimiter(time.Duration(float64(time.Second) / requestsPerSecond)),
+	}
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.limiter.Wait(req.Context()); err != nil {
+		return nil, err
+	}
+	return t.next.RoundTrip(req)
+}
+
+// intervalLimiter spaces the requests evenly, so at most one request per interval is allowed.
+// There is no burst, as the limit is meant to spread the requests of a scrape instead of sending them at once.
+type intervalLimiter struct {
+	interval time.Duration
+
+	mu          sync.Mutex
+	nextRequest time.Time
+}
+
+func newIntervalLimiter(interval time.Duration) *intervalLimiter {
+	return &intervalLimiter{interval: interval}
+}
+
+// Wait takes the next free slot, a request which is canceled while waiting doesn't take any slot.
+func (l *intervalLimiter) Wait(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		wait := l.nextRequest.Sub(now)
+		if wait <= 0 {
+			l.nextRequest = now.Add(l.interval)
+			l.mu.Unlock()
+			return nil
+		}
+		l.mu.Unlock()
+
+		// wait for the slot, other requests waiting for it might take it first
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
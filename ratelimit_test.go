@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// roundTripFunc is a http.RoundTripper answering all requests with fn.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (fn roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return fn(req)
+}
+
+func newRateLimitTestRequest(t *testing.T, ctx context.Context) *http.Request {
+	t.Helper()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://pbs.invalid:8007/api2/json/version", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+// limiterFunc is a limiter waiting with fn.
+type limiterFunc func(ctx context.Context) error
+
+func (fn limiterFunc) Wait(ctx context.Context) error {
+	return fn(ctx)
+}
+
+func TestRateLimitTransportWaitsForLimiter(t *testing.T) {
+	sent := 0
+	next := roundTripFunc(func(*http.Request) (*http.Response, error) {
+		sent++
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	})
+
+	// the request is only sent if the limiter allows it
+	waitErr := errors.New("rate limited")
+	transport := &rateLimitTransport{next: next, limiter: limiterFunc(func(context.Context) error {
+		return waitErr
+	})}
+	if _, err := transport.RoundTrip(newRateLimitTestRequest(t, context.Background())); !errors.Is(err, waitErr) {
+		t.Errorf("expected the error of the limiter, got %v", err)
+	}
+	if sent != 0 {
+		t.Errorf("expected no request to be sent, got %d", sent)
+	}
+
+	// the limiter waits with the context of the request
+	type key struct{}
+	ctx := context.WithValue(context.Background(), key{}, "scrape")
+	transport.limiter = limiterFunc(func(waitCtx context.Context) error {
+		if waitCtx.Value(key{}) != "scrape" {
+			t.Error("the limiter did not get the context of the request")
+		}
+		return nil
+	})
+	if _, err := transport.RoundTrip(newRateLimitTestRequest(t, ctx)); err != nil {
+		t.Fatal(err)
+	}
+	if sent != 1 {
+		t.Errorf("expected a single request to be sent, got %d", sent)
+	}
+}
+
+func TestIntervalLimiterCanceledRequest(t *testing.T) {
+	limiter := newIntervalLimiter(time.Hour)
+	if err := limiter.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	nextRequest := limiter.nextRequest
+
+	// the next slot is an hour away, a canceled request returns without taking it
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := limiter.Wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the request to be canceled, got %v", err)
+	}
+	if !limiter.nextRequest.Equal(nextRequest) {
+		t.Errorf("the canceled request took the slot at %s", limiter.nextRequest)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/natrontech/pbs-exporter/collector"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// secretFiles are the files the credentials were read from, set in main.
+// They are read again on SIGHUP, which allows to rotate the api token without restarting the exporter.
+var secretFiles struct {
+	username     string
+	apitoken     string
+	apitokenname string
+}
+
+// currentCredentials returns the username, api token and api token name to use for new exporters.
+func currentCredentials() (string, string, string) {
+	credentialsMu.RLock()
+	defer credentialsMu.RUnlock()
+	return *username, *apitoken, *apitokenname
+}
+
+// reloadCredentials reads the secret files again and updates the credentials
+// of new exporters and of the given running exporters.
+func reloadCredentials(exporters []*collector.Exporter) error {
+	newUsername, newApitoken, newApitokenname := currentCredentials()
+
+	var err error
+	if secretFiles.username != "" {
+		newUsername, err = readSecretFile(secretFiles.username)
+		if err != nil {
+			return err
+		}
+	}
+	if secretFiles.apitoken != "" {
+		newApitoken, err = readSecretFile(secretFiles.apitoken)
+		if err != nil {
+			return err
+		}
+	}
+	if secretFiles.apitokenname != "" {
+		newApitokenname, err = readSecretFile(secretFiles.apitokenname)
+		if err != nil {
+			return err
+		}
+	}
+
+	if newApitoken != "" && newApitokenname == "" {
+		return errors.New("api token name must not be empty")
+	}
+
+	credentialsMu.Lock()
+	*username = newUsername
+	*apitoken = newApitoken
+	*apitokenname = newApitokenname
+	credentialsMu.Unlock()
+
+	for _, exporter := range exporters {
+		exporter.SetCredentials(newUsername, newApitoken, newApitokenname)
+	}
+	stateByTarget.resetActiveTokens()
+	return nil
+}
+
+// reloadCounters count the successful and failed reloads on SIGHUP.
+type reloadCounters struct {
+	success prometheus.Counter
+	failure prometheus.Counter
+}
+
+func newReloadCounters(constLabels prometheus.Labels) reloadCounters {
+	return reloadCounters{
+		success: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   promNamespace,
+			Name:        "config_reload_success_total",
+			Help:        "The number of successful reloads of the secret files on SIGHUP.",
+			ConstLabels: constLabels,
+		}),
+		failure: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   promNamespace,
+			Name:        "config_reload_failure_total",
+			Help:        "The number of failed reloads of the secret files on SIGHUP, the current credentials were kept.",
+			ConstLabels: constLabels,
+		}),
+	}
+}
+
+// handleReload reloads the credentials on SIGHUP. It never returns.
+func handleReload(exporters []*collector.Exporter, reloads reloadCounters) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		err := reloadCredentials(exporters)
+		if err != nil {
+			reloads.failure.Inc()
+			log.Printf("ERROR: Unable to reload credentials, keeping the current ones: %s", err)
+			continue
+		}
+		reloads.success.Inc()
+		log.Printf("INFO: Reloaded credentials from secret files")
+	}
+}
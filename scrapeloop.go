@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/natrontech/pbs-exporter/collector"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// scrapeLoop collects the metrics of an exporter on a fixed interval in the background
+// and serves the most recent result, independent of how often it is scraped itself.
+type scrapeLoop struct {
+	exporter *collector.Exporter
+	interval time.Duration
+	metrics  atomic.Pointer[[]prometheus.Metric]
+}
+
+func newScrapeLoop(exporter *collector.Exporter, interval time.Duration) *scrapeLoop {
+	return &scrapeLoop{
+		exporter: exporter,
+		interval: interval,
+	}
+}
+
+// run refreshes the metrics immediately and then on every interval. It never returns.
+func (s *scrapeLoop) run() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		s.refresh()
+		<-ticker.C
+	}
+}
+
+func (s *scrapeLoop) refresh() {
+	start := time.Now()
+
+	ch := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	var metrics []prometheus.Metric
+	go func() {
+		for m := range ch {
+			metrics = append(metrics, m)
+		}
+		close(done)
+	}()
+	s.exporter.Collect(ch)
+	close(ch)
+	<-done
+
+	s.metrics.Store(&metrics)
+
+	// debug
+	if *loglevel == "debug" {
+		log.Printf("DEBUG: Background scrape collected %d metrics in %s", len(metrics), time.Since(start))
+	}
+}
+
+func (s *scrapeLoop) Describe(ch chan<- *prometheus.Desc) {
+	s.exporter.Describe(ch)
+}
+
+func (s *scrapeLoop) Collect(ch chan<- prometheus.Metric) {
+	metrics := s.metrics.Load()
+	if metrics == nil {
+		// first background scrape has not finished yet
+		return
+	}
+	for _, m := range *metrics {
+		ch <- m
+	}
+}